@@ -0,0 +1,120 @@
+package raft
+
+import (
+	"sync"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A clock is the source of time for election and heartbeat timeouts. It allows
+// tests to control time instead of waiting on the wall clock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+// A real clock uses the system time.
+type RealClock struct{}
+
+// A fake clock only moves forward when it is advanced manually.
+type FakeClock struct {
+	now     time.Time
+	waiters []*fakeClockWaiter
+	mutex   sync.Mutex
+}
+
+// A channel waiting for a fake clock to reach a given time.
+type fakeClockWaiter struct {
+	until time.Time
+	c     chan time.Time
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Creates a new fake clock set to the given time.
+func NewFakeClock(epoch time.Time) *FakeClock {
+	return &FakeClock{now: epoch}
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Real Clock
+//--------------------------------------
+
+// Returns the current system time.
+func (c RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// Returns a channel that receives the time after the duration has elapsed.
+func (c RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Pauses the current goroutine for the duration.
+func (c RealClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+//--------------------------------------
+// Fake Clock
+//--------------------------------------
+
+// Returns the current time of the fake clock.
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Returns a channel that receives the time once the clock has been advanced by
+// at least the duration.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	w := &fakeClockWaiter{until: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.c <- c.now
+	} else {
+		c.waiters = append(c.waiters, w)
+	}
+	return w.c
+}
+
+// Blocks until the clock has been advanced by at least the duration.
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Moves the clock forward and fires any channels whose time has been reached.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if !w.until.After(c.now) {
+			w.c <- c.now
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	c.waiters = waiters
+}
@@ -0,0 +1,83 @@
+package raft
+
+import (
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that a fake clock only fires timers once it has been advanced.
+func TestFakeClockAdvance(t *testing.T) {
+	epoch := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(epoch)
+	c1 := clock.After(100 * time.Millisecond)
+	c2 := clock.After(300 * time.Millisecond)
+
+	clock.Advance(150 * time.Millisecond)
+	select {
+	case now := <-c1:
+		if !now.Equal(epoch.Add(150 * time.Millisecond)) {
+			t.Fatalf("Unexpected time: %v", now)
+		}
+	default:
+		t.Fatalf("Expected first timer to fire")
+	}
+	select {
+	case <-c2:
+		t.Fatalf("Unexpected second timer")
+	default:
+	}
+
+	clock.Advance(150 * time.Millisecond)
+	select {
+	case <-c2:
+	default:
+		t.Fatalf("Expected second timer to fire")
+	}
+	if now := clock.Now(); !now.Equal(epoch.Add(300 * time.Millisecond)) {
+		t.Fatalf("Unexpected time: %v", now)
+	}
+}
+
+// Ensure that sleeping on a fake clock blocks until the clock is advanced.
+func TestFakeClockSleep(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	done := make(chan bool)
+	go func() {
+		clock.Sleep(time.Second)
+		close(done)
+	}()
+
+	// Wait for the sleeper to register before advancing.
+	for {
+		clock.mutex.Lock()
+		n := len(clock.waiters)
+		clock.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Sleep did not return after advance")
+	}
+}
+
+// Ensure that the server uses the clock it was created with.
+func TestServerWithClock(t *testing.T) {
+	clock := NewFakeClock(time.Unix(0, 0))
+	if s := NewServer(WithClock(clock)); s.clock != clock {
+		t.Fatalf("Unexpected clock: %v", s.clock)
+	}
+	if s := NewServer(); s.clock != (RealClock{}) {
+		t.Fatalf("Unexpected default clock: %v", s.clock)
+	}
+}
@@ -1,5 +1,17 @@
 package raft
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// Reserved names of the commands used for Raft's own bookkeeping.
+const (
+	NoOpCommandName         = "__noop__"
+	ConfigChangeCommandName = "__config__"
+)
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
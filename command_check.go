@@ -0,0 +1,141 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The severity of an issue found by CheckCommand.
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// Severity describes how serious an issue is.
+type Severity int
+
+// An issue is a problem found with a command type.
+type Issue struct {
+	Command     string
+	Severity    Severity
+	Description string
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Checks that a command type can be stored in a log. Its name must be set,
+// must not depend on the command's fields and must not be reserved, and its
+// JSON encoding must survive a decode and encode unchanged.
+// 在AddCommandType之前检查command的实现有没有问题
+func CheckCommand(command Command) []Issue {
+	if command == nil {
+		return []Issue{{Severity: SeverityError, Description: "Command is nil"}}
+	}
+
+	name := command.Name()
+	var issues []Issue
+	add := func(severity Severity, format string, a ...interface{}) {
+		issues = append(issues, Issue{Command: name, Severity: severity, Description: fmt.Sprintf(format, a...)})
+	}
+
+	// Decoded commands are looked up by the name of a zero value so the name
+	// must be the same for every instance.
+	if name == "" {
+		add(SeverityError, "Name() is empty")
+	} else if name == NoOpCommandName || name == ConfigChangeCommandName {
+		add(SeverityError, "Name() %q is reserved", name)
+	}
+	if other := command.Name(); other != name {
+		add(SeverityError, "Name() is not consistent: %q != %q", name, other)
+	}
+	copy := newCommandLike(command)
+	if copy == nil {
+		add(SeverityError, "Unable to copy command of type %T", command)
+		return issues
+	} else if other := copy.Name(); other != name {
+		add(SeverityError, "Name() depends on the command's fields: %q != %q", name, other)
+	}
+
+	// Encode, decode and encode again.
+	a, err := json.Marshal(command)
+	if err != nil {
+		add(SeverityError, "Unable to encode: %v", err)
+		return issues
+	}
+	if err := json.Unmarshal(a, &copy); err != nil {
+		add(SeverityError, "Unable to decode: %v", err)
+		return issues
+	}
+	b, err := json.Marshal(copy)
+	if err != nil {
+		add(SeverityError, "Unable to encode decoded command: %v", err)
+	} else if !bytes.Equal(a, b) {
+		// LogEntry.Validate rejects these so they can never be stored.
+		add(SeverityError, "JSON encoding does not roundtrip: %s != %s", a, b)
+	}
+
+	return issues
+}
+
+// Checks every command type registered with a log, in name order.
+func CheckAllRegistered(log *Log) []Issue {
+	commandTypes := log.registeredCommandTypes()
+	names := make([]string, 0, len(commandTypes))
+	for name := range commandTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var issues []Issue
+	for _, name := range names {
+		issues = append(issues, CheckCommand(commandTypes[name])...)
+	}
+	return issues
+}
+
+// Returns a new zero value of a command's type, or nil if it does not
+// implement Command.
+func newCommandLike(command Command) Command {
+	v := reflect.New(reflect.Indirect(reflect.ValueOf(command)).Type()).Interface()
+	copy, _ := v.(Command)
+	return copy
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.Severity, i.Command, i.Description)
+}
@@ -0,0 +1,64 @@
+package raft
+
+import (
+	"strings"
+	"testing"
+)
+
+// A command whose name depends on its fields and whose JSON loses data.
+type testBrokenCommand struct {
+	Key    string `json:"key"`
+	secret string
+}
+
+func (c *testBrokenCommand) Name() string {
+	return "broken:" + c.Key
+}
+
+func (c *testBrokenCommand) MarshalJSON() ([]byte, error) {
+	return []byte(`{"key":"` + c.Key + `","secret":"` + c.secret + `"}`), nil
+}
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that a well-behaved command has no issues.
+func TestCheckCommand(t *testing.T) {
+	if issues := CheckCommand(&TestCommand1{"foo", 20}); len(issues) != 0 {
+		t.Fatalf("Unexpected issues: %v", issues)
+	}
+	if issues := CheckCommand(&testNoOpCommand{}); len(issues) != 1 || !strings.Contains(issues[0].Description, "reserved") {
+		t.Fatalf("Expected reserved name issue: %v", issues)
+	}
+}
+
+// Ensure that a broken command reports each of its issues.
+func TestCheckCommandBroken(t *testing.T) {
+	issues := CheckCommand(&testBrokenCommand{Key: "k", secret: "s"})
+	if len(issues) != 2 {
+		t.Fatalf("Expected 2 issues: %v", issues)
+	}
+	if issues[0].Severity != SeverityError || !strings.Contains(issues[0].Description, "depends on the command's fields") {
+		t.Fatalf("Unexpected issue[0]: %v", issues[0])
+	}
+	if issues[1].Severity != SeverityError || !strings.Contains(issues[1].Description, "roundtrip") {
+		t.Fatalf("Unexpected issue[1]: %v", issues[1])
+	}
+	if s := issues[1].String(); !strings.HasPrefix(s, "error: broken:k: ") {
+		t.Fatalf("Unexpected string: %s", s)
+	}
+}
+
+// Ensure that every registered command is checked.
+func TestCheckAllRegistered(t *testing.T) {
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&testConfigChangeCommand{})
+	issues := CheckAllRegistered(log)
+	if len(issues) != 1 || issues[0].Command != ConfigChangeCommandName {
+		t.Fatalf("Unexpected issues: %v", issues)
+	}
+}
@@ -2,14 +2,31 @@ package raft
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The default time Append waits for each callback registered with OnAppend.
+const DefaultAppendCallbackTimeout = 100 * time.Millisecond
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -19,12 +36,86 @@ import (
 // A log is a collection of log entries that are persisted to durable storage.
 type Log struct {
 	file *os.File
+	writer io.Writer
+	buffer *bufio.Writer
+	writeBufferSize int
+	path string
+	walFile *os.File
 	entries      []*LogEntry
+	pending      []*LogEntry
 	commitIndex  uint64
 	commandTypes map[string]Command
+	commandMutex sync.RWMutex
 	mutex sync.Mutex
+	recoveryWorkers int
+	checksumInterval int
+	strictRecovery bool
+	idempotentCommit bool
+	skipValidation   bool
+	ephemeral        bool
+	snapshotIndex uint64
+	compactIndex uint64
+	compactTerm uint64
+	termFiles bool
+	fileTerm uint64
+	metadata *LogMetadata
+	appendCallbacks []func(*LogEntry)
+	appendCallbackTimeout time.Duration
+	commitCallbacks []func(*LogEntry)
+	committed chan struct{}
+	commitWaiters map[uint64][]chan error
+}
+
+// A repair report describes the changes made to a log file by Repair(). The
+// truncation index is the index following the last good entry.
+type RepairReport struct {
+	GoodEntries      int
+	TruncatedAtIndex uint64
+	BackupPath       string
+}
+
+// Log metadata summarizes the entries of a log without the entries themselves.
+// SnapshotLastIndex is the last entry compacted into the snapshot by Compact().
+type LogMetadata struct {
+	FirstIndex        uint64 `json:"firstIndex"`
+	LastIndex         uint64 `json:"lastIndex"`
+	CommitIndex       uint64 `json:"commitIndex"`
+	EntryCount        int    `json:"entryCount"`
+	SnapshotLastIndex uint64 `json:"snapshotLastIndex"`
+}
+
+// The number of bytes used on disk by a log's files. LogBytes includes the
+// write-ahead log and ArchiveBytes counts the files archived by Rotate().
+type DiskUsage struct {
+	LogBytes      int64
+	SnapshotBytes int64
+	IndexBytes    int64
+	ArchiveBytes  int64
+	Total         int64
+}
+
+// A dedup report describes the entries removed by DeduplicateEntries().
+type DedupReport struct {
+	DuplicatesRemoved int
+}
+
+// A point-in-time view of a log's entries. FirstIndex is the index of the
+// first entry, or zero if there are no entries.
+type LogSnapshot struct {
+	Entries     []*LogEntry
+	CommitIndex uint64
+	FirstIndex  uint64
 }
 
+// An error returned by Open in strict recovery mode when the log file contains
+// a corrupt or partially written entry.
+type ErrPartialEntry struct {
+	AtOffset int64
+}
+
+// A log option configures a log when it is created.
+type LogOption func(*Log)
+
 //------------------------------------------------------------------------------
 //
 // Constructor
@@ -32,9 +123,101 @@ type Log struct {
 //------------------------------------------------------------------------------
 
 // Creates a new log.
-func NewLog() *Log {
-	return &Log{
+func NewLog(options ...LogOption) *Log {
+	l := &Log{
 		commandTypes: make(map[string]Command),
+		checksumInterval: 1,
+		appendCallbackTimeout: DefaultAppendCallbackTimeout,
+	}
+	for _, option := range options {
+		option(l)
+	}
+	return l
+}
+
+//--------------------------------------
+// Options
+//--------------------------------------
+
+// Decodes entries on Open using a pool of workers. Entries are still read from
+// the file sequentially but their commands are decoded concurrently.
+func WithParallelRecovery(workers int) LogOption {
+	return func(l *Log) {
+		l.recoveryWorkers = workers
+	}
+}
+
+// Verifies the checksum of only every nth entry read by Open. The remaining
+// entries are still fully decoded. The default of 1 verifies every entry and 0
+// disables verification.
+// 用安全性换恢复速度
+func WithChecksumVerifyInterval(n int) LogOption {
+	return func(l *Log) {
+		l.checksumInterval = n
+	}
+}
+
+// Disables checksum verification of entries read by Open.
+func WithChecksumVerifyNone() LogOption {
+	return WithChecksumVerifyInterval(0)
+}
+
+// Makes Open return ErrPartialEntry instead of truncating the log file when it
+// finds a corrupt or partially written entry. The file can then be fixed with
+// Repair() before opening it again.
+func WithStrictRecovery(enabled bool) LogOption {
+	return func(l *Log) {
+		l.strictRecovery = enabled
+	}
+}
+
+// Makes SetCommitIndex a no-op instead of an error when the index has already
+// been committed. This allows commits to be retried safely.
+func WithIdempotentSetCommitIndex(enabled bool) LogOption {
+	return func(l *Log) {
+		l.idempotentCommit = enabled
+	}
+}
+
+// Sets the index of the last entry included in the state machine's snapshot.
+// Replay() skips entries up to and including this index.
+func WithSnapshotIndex(index uint64) LogOption {
+	return func(l *Log) {
+		l.snapshotIndex = index
+	}
+}
+
+// Writes entries to a separate file for each term named "<base>-term-<N>.log",
+// where base is the log path without a ".log" extension. A new file is started
+// whenever an entry from a new term is committed.
+func WithPerTermFiles(enabled bool) LogOption {
+	return func(l *Log) {
+		l.termFiles = enabled
+	}
+}
+
+// Buffers writes to the log file in memory, flushing them whenever entries are
+// committed and when the log is closed. The default of 0 writes each entry to
+// the file directly.
+func WithWriteBufferSize(n int) LogOption {
+	return func(l *Log) {
+		l.writeBufferSize = n
+	}
+}
+
+// Skips the LogEntry.Validate() check on entries as they are appended and at
+// the end of decoding each entry.
+func WithSkipValidation(skip bool) LogOption {
+	return func(l *Log) {
+		l.skipValidation = skip
+	}
+}
+
+// Sets how long Append waits for each callback registered with OnAppend before
+// dropping it. A timeout of 0 calls callbacks directly and always waits.
+func WithAppendCallbackTimeout(timeout time.Duration) LogOption {
+	return func(l *Log) {
+		l.appendCallbackTimeout = timeout
 	}
 }
 
@@ -44,6 +227,14 @@ func NewLog() *Log {
 //
 //------------------------------------------------------------------------------
 
+//--------------------------------------
+// Errors
+//--------------------------------------
+
+func (e ErrPartialEntry) Error() string {
+	return fmt.Sprintf("raft.Log: Corrupt or partial entry at offset %d", e.AtOffset)
+}
+
 //--------------------------------------
 // Commands
 //--------------------------------------
@@ -51,9 +242,17 @@ func NewLog() *Log {
 // Instantiates a new command by type name. Returns an error if the command type
 // has not been registered already.
 // 根据command name来反射出具体的command class，然后new出相应的对象
-func (l *Log) NewCommand(name string) (Command, error) {
+func (l *Log) NewCommand(name string) (_ Command, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = ErrDecodePanic{Recovered: r}
+		}
+	}()
+
 	// Find the registered command.
+	l.commandMutex.RLock()
 	command := l.commandTypes[name]
+	l.commandMutex.RUnlock()
 	if command == nil {
 		return nil, fmt.Errorf("raft.Log: Unregistered command type: %s", name)
 	}
@@ -71,6 +270,8 @@ func (l *Log) NewCommand(name string) (Command, error) {
 // deserialized each time a new log entry is read. This function will panic
 // if a command type with the same name already exists.
 func (l *Log) AddCommandType(command Command) {
+	l.commandMutex.Lock()
+	defer l.commandMutex.Unlock()
 	if command == nil {
 		panic(fmt.Sprintf("raft.Log: Command type cannot be nil"))
 	} else if l.commandTypes[command.Name()] != nil {
@@ -79,136 +280,1800 @@ func (l *Log) AddCommandType(command Command) {
 	l.commandTypes[command.Name()] = command
 }
 
+// Removes every registered command type so they can be registered again, such
+// as when a plugin is reloaded. Returns an error if the log is open since its
+// entries could no longer be decoded.
+// 插件热加载时先清空所有command type，再重新AddCommandType
+func (l *Log) ResetCommandTypes() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.writer != nil {
+		return errors.New("raft.Log: Cannot reset command types while log is open")
+	}
+	l.commandMutex.Lock()
+	defer l.commandMutex.Unlock()
+	l.commandTypes = make(map[string]Command)
+	return nil
+}
+
+// Replaces a registered command type with another of the same name. Returns
+// an error instead of panicking if the command is nil or not registered yet.
+// The log can stay open; entries decoded afterward use the new type.
+func (l *Log) ReplaceCommandType(command Command) error {
+	if command == nil {
+		return errors.New("raft.Log: Command type cannot be nil")
+	}
+	l.commandMutex.Lock()
+	defer l.commandMutex.Unlock()
+	if l.commandTypes[command.Name()] == nil {
+		return fmt.Errorf("raft.Log: Command type does not exist: %s", command.Name())
+	}
+	l.commandTypes[command.Name()] = command
+	return nil
+}
+
+// Returns a copy of the registered command types.
+func (l *Log) registeredCommandTypes() map[string]Command {
+	l.commandMutex.RLock()
+	defer l.commandMutex.RUnlock()
+	commandTypes := make(map[string]Command, len(l.commandTypes))
+	for name, command := range l.commandTypes {
+		commandTypes[name] = command
+	}
+	return commandTypes
+}
+
 //--------------------------------------
-// State
+// Entries
 //--------------------------------------
 
-// Opens the log file and reads existing entries. The log can remain open and
-// continue to append entries to the end of the log.
-// Open做了两件事
-// 1. 读出log文件里所有的log entry
-// 2. 打开log文件，供追加log entry
-func (l *Log) Open(path string) error {
+// Retrieves the entry at the given index. Returns nil if the log does not
+// contain an entry at that index.
+func (l *Log) GetEntry(index uint64) *LogEntry {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
+	if i := l.search(index); i < len(l.entries) && l.entries[i].index == index {
+		return l.entries[i]
+	}
+	return nil
+}
 
-	// Read all the entries from the log if one exists.
-	var lastIndex int = 0
-	if _, err := os.Stat(path); !os.IsNotExist(err) {
-		// Open the log file.
-		file, err := os.Open(path)
-		if err != nil {
+// Returns the number of bytes an entry will take up in the log file without
+// writing it. The size is cached on the entry once calculated.
+func (l *Log) EncodedSize(entry *LogEntry) (int, error) {
+	if entry == nil {
+		return 0, errors.New("raft.Log: Entry required")
+	}
+	return entry.encodedSize()
+}
+
+// Returns the position of the first entry with an index greater than or equal
+// to the given index. The caller must hold the lock.
+func (l *Log) search(index uint64) int {
+	return sort.Search(len(l.entries), func(i int) bool { return l.entries[i].index >= index })
+}
+
+// Returns a copy of up to the first n entries in the log. Panics if n is
+// negative.
+func (l *Log) Head(n int) []*LogEntry {
+	if n < 0 {
+		panic(fmt.Sprintf("raft.Log: Invalid entry count: %d", n))
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if n > len(l.entries) {
+		n = len(l.entries)
+	}
+	return append([]*LogEntry{}, l.entries[:n]...)
+}
+
+// Returns a copy of up to the last n entries in the log. Panics if n is
+// negative.
+func (l *Log) Tail(n int) []*LogEntry {
+	if n < 0 {
+		panic(fmt.Sprintf("raft.Log: Invalid entry count: %d", n))
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if n > len(l.entries) {
+		n = len(l.entries)
+	}
+	return append([]*LogEntry{}, l.entries[len(l.entries)-n:]...)
+}
+
+// Calls a function for each entry in the snapshot up to its commit index.
+// Iteration stops at the first error, which is returned. No lock is held so
+// this can run concurrently with appends to the log.
+func (s LogSnapshot) Iterate(fn func(*LogEntry) error) error {
+	for _, entry := range s.Entries {
+		if entry.index > s.CommitIndex {
+			break
+		}
+		if err := fn(entry); err != nil {
 			return err
 		}
-		defer file.Close()
-		reader := bufio.NewReader(file)
+	}
+	return nil
+}
 
-		// Read the file and decode entries.
-		for {
-			if _, err := reader.Peek(1); err == io.EOF {
-				break
-			}
+// Calls a function for each entry from the last to the first until it returns
+// false. The log is locked while the function is called so it must not call
+// back into the log.
+func (l *Log) ReverseEntries(fn func(*LogEntry) bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 
-			// Instantiate log entry and decode into it.
-			entry := NewLogEntry(l, 0, 0, nil)
-			n, err := entry.Decode(reader)
-			if err != nil {
-				warn("raft.Log: %v", err)
-				warn("raft.Log: Recovering (%d)", lastIndex)
-				file.Close()
-				if err = os.Truncate(path, int64(lastIndex)); err != nil {
-					return fmt.Errorf("raft.Log: Unable to recover: %v", err)
-				}
-				break
-			}
-			l.commitIndex = entry.index
-			lastIndex += n
+	if l.writer == nil {
+		return errors.New("raft.Log: Log is not open")
+	}
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if !fn(l.entries[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Returns a copy of the entries from a term in index order. Terms never
+// decrease through the log so the entries are found with a binary search.
+func (l *Log) PrefixScan(term uint64) ([]*LogEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return nil, errors.New("raft.Log: Log is not open")
+	}
+	i := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].term >= term })
+	j := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].term > term })
+	return append([]*LogEntry{}, l.entries[i:j]...), nil
+}
+
+// Returns the number of committed entries that match a predicate. The log is
+// locked while the predicate is called so it must not call back into the log.
+func (l *Log) CountEntries(pred func(*LogEntry) bool) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 
-			// Append entry.
-			l.entries = append(l.entries, entry)
+	n := 0
+	for _, entry := range l.entries {
+		if entry.index > l.commitIndex {
+			break
+		} else if pred(entry) {
+			n++
 		}
+	}
+	return n
+}
 
-		file.Close()
+// Returns the committed entries that match a predicate. The log is locked
+// while the predicate is called so it must not call back into the log.
+func (l *Log) FilterEntries(pred func(*LogEntry) bool) []*LogEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var entries []*LogEntry
+	for _, entry := range l.entries {
+		if entry.index > l.commitIndex {
+			break
+		} else if pred(entry) {
+			entries = append(entries, entry)
+		}
 	}
+	return entries
+}
 
-	// Open the file for appending.
-	var err error
-	l.file, err = os.OpenFile(path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600)
-	if err != nil {
-		return err
+// Captures the current entries and commit index. Only the slice is copied so
+// the snapshot is cheap to take and can be read without holding the lock.
+// 只复制slice header，不复制entry本身
+func (l *Log) Snapshot() (LogSnapshot, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return LogSnapshot{}, errors.New("raft.Log: Log is not open")
 	}
 
-	return nil
+	snapshot := LogSnapshot{
+		Entries:     l.entries[:len(l.entries):len(l.entries)],
+		CommitIndex: l.commitIndex,
+	}
+	if len(l.entries) > 0 {
+		snapshot.FirstIndex = l.entries[0].index
+	}
+	return snapshot, nil
 }
 
-// Closes the log file.
-func (l *Log) Close() {
+// Calls a function for each committed entry in index order without copying
+// the entries. Iteration stops at the first error, which is returned. The log
+// is locked for the whole iteration so the function should be quick, must not
+// call back into the log and must not keep the entry after it returns.
+// 整个遍历过程都持有锁，比Replay少一次复制
+func (l *Log) IterateCommitted(fn func(*LogEntry) error) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
-	if l.file != nil {
-		l.file.Close()
-		l.file = nil
+	for _, entry := range l.entries {
+		if entry.index > l.commitIndex {
+			break
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
 	}
-	l.entries = make([]*LogEntry, 0)
+	return nil
+}
+
+// Calls a function for each committed entry in index order, starting after
+// the snapshot index. Iteration stops at the first error, which is returned.
+// The log is not locked while the function is called.
+// 状态机启动时用Replay重放所有已commit的entry
+func (l *Log) Replay(fn func(*LogEntry) error) error {
+	l.mutex.Lock()
+	var entries []*LogEntry
+	for _, entry := range l.entries {
+		if entry.index > l.snapshotIndex && entry.index <= l.commitIndex {
+			entries = append(entries, entry)
+		}
+	}
+	l.mutex.Unlock()
+
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 //--------------------------------------
-// Append
+// Metadata
 //--------------------------------------
 
-// Updates the commit index and writes entries after that index to the stable
-// storage.
-func (l *Log) SetCommitIndex(index uint64) error {
+// Returns a summary of the log's entries. A closed log returns the metadata
+// most recently unmarshaled into it, if any.
+func (l *Log) Metadata() LogMetadata {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
+	return l.meta()
+}
 
-	// Do not allow previous indices to be committed again.
-	if index < l.commitIndex {
-		return fmt.Errorf("raft.Log: Commit index (%d) ahead of requested commit index (%d)", l.commitIndex, index)
+// Returns a summary of the log's entries. The caller must hold the lock.
+func (l *Log) meta() LogMetadata {
+	if l.writer == nil && l.metadata != nil {
+		return *l.metadata
 	}
 
-	// Find all entries whose index is between the previous index and the current index.
-	for _, entry := range l.entries {
-		if entry.index > l.commitIndex && entry.index <= index {
-			// Write to storage.
-			if err := entry.Encode(l.file); err != nil {
-				return err
-			}
+	m := LogMetadata{CommitIndex: l.commitIndex, EntryCount: len(l.entries), SnapshotLastIndex: l.compactIndex}
+	if len(l.entries) > 0 {
+		m.FirstIndex = l.entries[0].index
+		m.LastIndex = l.entries[len(l.entries)-1].index
+	}
+	return m
+}
 
-			// Update commit index.
-			l.commitIndex = entry.index
-		}
+// Encodes the log's metadata as JSON. Entries are not included.
+func (l *Log) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Metadata())
+}
+
+// Decodes and validates log metadata. The entries of the log are not restored
+// so this can only be used on a closed log. The decoded metadata is available
+// afterward through Metadata().
+func (l *Log) UnmarshalJSON(b []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer != nil {
+		return errors.New("raft.Log: Cannot unmarshal into an open log")
+	}
+
+	var m LogMetadata
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+
+	// Validate that the indices are consistent with each other.
+	if m.EntryCount < 0 {
+		return fmt.Errorf("raft.Log: Invalid entry count: %d", m.EntryCount)
+	} else if m.EntryCount == 0 && (m.FirstIndex != 0 || m.LastIndex != 0) {
+		return fmt.Errorf("raft.Log: Indices set without entries (%d-%d)", m.FirstIndex, m.LastIndex)
+	} else if m.FirstIndex > m.LastIndex {
+		return fmt.Errorf("raft.Log: First index (%d) ahead of last index (%d)", m.FirstIndex, m.LastIndex)
+	} else if m.EntryCount > 0 && uint64(m.EntryCount) > m.LastIndex-m.FirstIndex+1 {
+		return fmt.Errorf("raft.Log: Too many entries (%d) for indices (%d-%d)", m.EntryCount, m.FirstIndex, m.LastIndex)
+	} else if m.CommitIndex > m.LastIndex && m.CommitIndex > m.SnapshotLastIndex {
+		// A compacted log can be committed through its snapshot with no entries.
+		return fmt.Errorf("raft.Log: Commit index (%d) ahead of last index (%d)", m.CommitIndex, m.LastIndex)
+	} else if m.SnapshotLastIndex > m.CommitIndex {
+		return fmt.Errorf("raft.Log: Snapshot index (%d) ahead of commit index (%d)", m.SnapshotLastIndex, m.CommitIndex)
 	}
 
+	l.metadata = &m
 	return nil
 }
 
 //--------------------------------------
-// Append
+// State
 //--------------------------------------
 
-// Writes a single log entry to the end of the log.
-func (l *Log) Append(entry *LogEntry) error {
+// Opens the log file and reads existing entries. The log can remain open and
+// continue to append entries to the end of the log.
+// Open做了两件事
+// 1. 读出log文件里所有的log entry
+// 2. 打开log文件，供追加log entry
+func (l *Log) Open(path string) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
+	l.path = path
+	l.ephemeral = false
 
-	if l.file == nil {
-		return errors.New("raft.Log: Log is not open")
+	// Leave the log closed on failure so it can be repaired and reopened.
+	if err := l.open(path); err != nil {
+		l.close()
+		return err
 	}
+	return nil
+}
 
-	// Make sure the term and index are greater than the previous.
-	if len(l.entries) > 0 {
-		lastEntry := l.entries[len(l.entries)-1]
-		if entry.term < lastEntry.term {
-			return fmt.Errorf("raft.Log: Cannot append entry with earlier term (%x:%x < %x:%x)", entry.term, entry.index, lastEntry.term, lastEntry.index)
-		} else if entry.index == lastEntry.index && entry.index <= lastEntry.index {
-			return fmt.Errorf("raft.Log: Cannot append entry with earlier index in the same term (%x:%x < %x:%x)", entry.term, entry.index, lastEntry.term, lastEntry.index)
-		}
+// Opens the log in memory only. Entries are committed without being encoded
+// or written anywhere so nothing survives Close. Per-term files are not used
+// and Sync does nothing. Returns an error if the log is already open.
+// 不需要持久化的场景（测试、单进程内共识）用内存log
+func (l *Log) OpenEphemeral() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.writer != nil {
+		return errors.New("raft.Log: Log is already open")
 	}
+	l.path = ""
+	l.writer = ioutil.Discard
+	l.ephemeral = true
+	return nil
+}
 
-	// Append to entries list if stored on disk.
-	l.entries = append(l.entries, entry)
+// Returns true if the log was opened with OpenEphemeral.
+func (l *Log) EphemeralMode() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.ephemeral
+}
+
+// Opens the log for appending encoded entries to a writer instead of a file.
+func (l *Log) OpenWriter(w io.Writer) error {
+	return l.OpenWriterReader(nil, w)
+}
+
+// Reads existing entries from a reader and opens the log for appending encoded
+// entries to a writer. The reader is optional. A corrupt entry cannot be
+// truncated from a reader so it is always returned as ErrPartialEntry. The
+// writer is not closed when the log is closed.
+func (l *Log) OpenWriterReader(r io.Reader, w io.Writer) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if w == nil {
+		return errors.New("raft.Log: Writer required to open")
+	} else if l.termFiles {
+		return errors.New("raft.Log: Per-term files require a log file")
+	}
+	l.path = ""
+	l.ephemeral = false
+
+	if r != nil {
+		reader := bufio.NewReader(r)
+		_, n, err := readHeader(reader)
+		if err != nil {
+			l.close()
+			return err
+		}
+		if pos, err := l.decodeEntries(reader); err != nil {
+			warn("raft.Log: %v", err)
+			l.close()
+			return ErrPartialEntry{AtOffset: int64(n + pos)}
+		}
+	}
+	l.writer = w
 
 	return nil
 }
+
+// Reads existing entries and opens the log file. The caller must hold the lock.
+func (l *Log) open(path string) error {
+	// Read all the entries from the log and open the file for appending.
+	if l.termFiles {
+		if err := l.openTermFiles(); err != nil {
+			return err
+		}
+	} else {
+		if _, err := l.readFile(path); err != nil {
+			return err
+		} else if err := l.openSnapshot(); err != nil {
+			return err
+		}
+
+		var err error
+		l.file, err = openLogFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	l.writer = l.fileWriter(l.file)
+
+	// Re-apply any entries left in the write-ahead log.
+	if err := l.openWAL(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Reads all the entries from a log file if it exists. A corrupt or incomplete
+// entry and anything after it is truncated from the file. Returns whether the
+// file was truncated.
+func (l *Log) readFile(path string) (bool, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	// Open the log file.
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	// Read the header, if any, and then decode entries.
+	_, n, err := readHeader(reader)
+	if err != nil {
+		return false, err
+	}
+	var lastIndex int
+	if l.recoveryWorkers > 1 {
+		lastIndex, err = l.decodeEntriesParallel(reader, l.recoveryWorkers)
+	} else {
+		lastIndex, err = l.decodeEntries(reader)
+	}
+	lastIndex += n
+	if _, ok := err.(ErrInvalidEntry); ok {
+		// The entry was written in full so truncating would lose data.
+		return false, err
+	} else if err != nil && l.strictRecovery {
+		warn("raft.Log: %v", err)
+		return false, ErrPartialEntry{AtOffset: int64(lastIndex)}
+	} else if err != nil {
+		warn("raft.Log: %v", err)
+		warn("raft.Log: Recovering (%d)", lastIndex)
+		file.Close()
+		if err = os.Truncate(path, int64(lastIndex)); err != nil {
+			return false, fmt.Errorf("raft.Log: Unable to recover: %v", err)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Decodes entries from a reader until the end of the reader or the first
+// invalid entry. Returns the number of bytes successfully decoded.
+func (l *Log) decodeEntries(reader *bufio.Reader) (int, error) {
+	pos, count := 0, 0
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			return pos, nil
+		}
+
+		// Instantiate log entry and decode into it.
+		entry := NewLogEntry(l, 0, 0, nil)
+		n, err := entry.decode(reader, l.verifyChecksum(count))
+		if err != nil {
+			return pos, err
+		}
+		l.commitIndex = entry.index
+		pos += n
+		count++
+
+		// Append entry.
+		l.entries = append(l.entries, entry)
+	}
+}
+
+// Returns whether the checksum of the nth entry read should be verified.
+func (l *Log) verifyChecksum(n int) bool {
+	return l.checksumInterval > 0 && n%l.checksumInterval == 0
+}
+
+// Decodes entries from a reader using a pool of workers. Encoded commands never
+// contain a newline so each line holds exactly one entry and the lines can be
+// decoded independently. Returns the number of bytes successfully decoded.
+// 先顺序按行切分，再并行decode，最后按顺序拼回l.entries
+func (l *Log) decodeEntriesParallel(reader *bufio.Reader, workers int) (int, error) {
+	// Split the reader into lines.
+	var lines [][]byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	// Decode the lines concurrently.
+	entries := make([]*LogEntry, len(lines))
+	errs := make([]error, len(lines))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range indices {
+				entries[j] = NewLogEntry(l, 0, 0, nil)
+				_, errs[j] = entries[j].decode(bufio.NewReader(bytes.NewReader(lines[j])), l.verifyChecksum(j))
+			}
+		}()
+	}
+	for i := range lines {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+
+	// Reassemble the entries in order, stopping at the first invalid entry.
+	pos := 0
+	for i, entry := range entries {
+		if errs[i] != nil {
+			return pos, errs[i]
+		}
+		l.commitIndex = entry.index
+		pos += len(lines[i])
+		l.entries = append(l.entries, entry)
+	}
+	return pos, nil
+}
+
+// Closes the log file.
+func (l *Log) Close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.close()
+}
+
+// Returns the writer for a log file, wrapped in a buffer if a write buffer
+// size is set. The caller must hold the lock.
+func (l *Log) fileWriter(file *os.File) io.Writer {
+	if l.writeBufferSize <= 0 {
+		l.buffer = nil
+		return file
+	}
+	l.buffer = bufio.NewWriterSize(file, l.writeBufferSize)
+	return l.buffer
+}
+
+// Writes any buffered entries to the log file. The caller must hold the lock.
+func (l *Log) flush() error {
+	if l.buffer == nil {
+		return nil
+	}
+	return l.buffer.Flush()
+}
+
+// Closes the log files and clears the entries. The caller must hold the lock.
+func (l *Log) close() {
+	if l.file != nil {
+		l.flush()
+		l.file.Close()
+		l.file = nil
+	}
+	l.writer, l.buffer = nil, nil
+	if l.walFile != nil {
+		l.walFile.Close()
+		l.walFile = nil
+	}
+	l.entries = make([]*LogEntry, 0)
+	l.pending = nil
+	l.commitIndex = 0
+	l.compactIndex, l.compactTerm = 0, 0
+	l.ephemeral = false
+	l.notifyCommitted()
+	l.releaseWaiters(0, ^uint64(0), errors.New("raft.Log: Log closed before entry was committed"))
+}
+
+// Flushes buffered writes and syncs the log file, and the write-ahead log if
+// there is one, to stable storage.
+func (l *Log) Sync() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return errors.New("raft.Log: Log is not open")
+	} else if l.ephemeral {
+		return nil
+	} else if l.file == nil {
+		return errors.New("raft.Log: Cannot sync a log that is not backed by a file")
+	}
+
+	if err := l.flush(); err != nil {
+		return err
+	} else if err := l.file.Sync(); err != nil {
+		return err
+	}
+	if l.walFile != nil {
+		return l.walFile.Sync()
+	}
+	return nil
+}
+
+// Archives the current log file as "<path>.<timestamp>.log" and starts a new,
+// empty log file at the original path. All entries remain available in
+// memory but archived files are not read when the log is opened again.
+// 归档后的文件只作为历史保留，l.entries不变
+func (l *Log) Rotate() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return errors.New("raft.Log: Log is not open")
+	} else if l.file == nil {
+		return errors.New("raft.Log: Cannot rotate a log that is not backed by a file")
+	} else if l.termFiles {
+		return errors.New("raft.Log: Cannot rotate per-term files")
+	}
+
+	// Close and archive the current file.
+	if err := l.flush(); err != nil {
+		return err
+	} else if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file, l.writer = nil, nil
+	archivePath := fmt.Sprintf("%s.%d.log", l.path, time.Now().UnixNano())
+	if err := os.Rename(l.path, archivePath); err != nil {
+		return fmt.Errorf("raft.Log: Unable to archive log: %v", err)
+	}
+
+	// Open a fresh file for appending.
+	var err error
+	if l.file, err = openLogFile(l.path); err != nil {
+		return err
+	}
+	l.writer = l.fileWriter(l.file)
+	return nil
+}
+
+// Truncates the log file at the first corrupt or incomplete entry after
+// copying the original file to "<path>.bak". The log must be closed and must
+// have been opened previously so that its path is known. This is typically
+// called after Open fails. The report has an empty backup path and a zero
+// truncation index if the file did not need any repair.
+// 跟Open里的自动恢复不一样，Repair会先把原文件备份再截断
+func (l *Log) Repair() (*RepairReport, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer != nil {
+		return nil, errors.New("raft.Log: Cannot repair an open log")
+	} else if l.path == "" {
+		return nil, errors.New("raft.Log: Log path is unknown")
+	} else if l.termFiles {
+		return nil, errors.New("raft.Log: Cannot repair per-term files")
+	}
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Decode into a scratch log so the entries of this log are untouched.
+	scratch := &Log{commandTypes: l.registeredCommandTypes(), checksumInterval: 1}
+	reader := bufio.NewReader(file)
+	_, n, err := readHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	pos, decodeErr := scratch.decodeEntries(reader)
+	pos += n
+	report := &RepairReport{GoodEntries: len(scratch.entries)}
+	if decodeErr == nil {
+		return report, nil
+	}
+	warn("raft.Log: Repairing: %v", decodeErr)
+
+	// Back up the original file before truncating it.
+	report.BackupPath = l.path + ".bak"
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	backup, err := os.OpenFile(report.BackupPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(backup, file); err != nil {
+		backup.Close()
+		return nil, fmt.Errorf("raft.Log: Unable to back up log: %v", err)
+	}
+	if err := backup.Close(); err != nil {
+		return nil, err
+	}
+
+	// Truncate the main file after the last good entry.
+	if err := os.Truncate(l.path, int64(pos)); err != nil {
+		return nil, fmt.Errorf("raft.Log: Unable to repair: %v", err)
+	}
+	report.TruncatedAtIndex = 1
+	if len(scratch.entries) > 0 {
+		report.TruncatedAtIndex = scratch.entries[len(scratch.entries)-1].index + 1
+	}
+
+	return report, nil
+}
+
+// Removes entries that repeat the index of the entry before them, keeping the
+// first copy, and rewrites the log file without them. The file is left as is
+// if there are no duplicates.
+// 正常情况下不会有重复；用于清理bug导致的同一个entry写了两次
+func (l *Log) DeduplicateEntries() (*DedupReport, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return nil, errors.New("raft.Log: Log is not open")
+	} else if l.file == nil {
+		return nil, errors.New("raft.Log: Cannot deduplicate a log that is not backed by a file")
+	} else if l.termFiles {
+		return nil, errors.New("raft.Log: Cannot deduplicate per-term files")
+	}
+
+	report := &DedupReport{}
+	entries := make([]*LogEntry, 0, len(l.entries))
+	for _, entry := range l.entries {
+		if len(entries) > 0 && entries[len(entries)-1].index == entry.index {
+			report.DuplicatesRemoved++
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if report.DuplicatesRemoved == 0 {
+		return report, nil
+	}
+
+	if err := l.rewriteFile(entries); err != nil {
+		return nil, err
+	}
+	l.entries = entries
+	return report, nil
+}
+
+//--------------------------------------
+// Append
+//--------------------------------------
+
+// Updates the commit index and writes entries after that index to the stable
+// storage.
+func (l *Log) SetCommitIndex(index uint64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.setCommitIndex(index)
+}
+
+// Updates the commit index and calls a function with the newly committed
+// entries after they are written to storage and before returning. The
+// function is not called if nothing was committed. It runs while the log is
+// locked so it must be quick and must not call back into the log; use
+// OnCommit and apply entries elsewhere if that is not possible.
+// 在commit的同一个goroutine里apply，省去异步的麻烦
+func (l *Log) SetCommitIndexWithCallback(index uint64, fn func([]*LogEntry)) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	committed, err := l.commitEntries(index)
+	if len(committed) > 0 {
+		fn(committed)
+	}
+	return err
+}
+
+// Updates the commit index. The caller must hold the lock.
+func (l *Log) setCommitIndex(index uint64) error {
+	_, err := l.commitEntries(index)
+	return err
+}
+
+// Updates the commit index and returns the entries that were committed. The
+// caller must hold the lock.
+func (l *Log) commitEntries(index uint64) ([]*LogEntry, error) {
+	committed, err := l.writeCommitted(index)
+	if ferr := l.flush(); err == nil {
+		err = ferr
+	}
+
+	// Notify callbacks of every entry that was committed, even on error.
+	for _, entry := range committed {
+		for _, fn := range l.commitCallbacks {
+			fn(entry)
+		}
+	}
+	if len(committed) > 0 {
+		l.notifyCommitted()
+		l.releaseWaiters(0, l.commitIndex, nil)
+	}
+
+	return committed, err
+}
+
+// Wakes up anything waiting for the commit index to change. The caller must
+// hold the lock.
+func (l *Log) notifyCommitted() {
+	if l.committed != nil {
+		close(l.committed)
+		l.committed = nil
+	}
+}
+
+// Blocks until every entry in the log has been committed or the context is
+// done. Returns the context's error if it is done first, or an error if the
+// log is closed while waiting.
+// 关闭server之前确认所有entry都已经commit
+func (l *Log) Drain(ctx context.Context) error {
+	for {
+		l.mutex.Lock()
+		if l.writer == nil {
+			l.mutex.Unlock()
+			return errors.New("raft.Log: Log is not open")
+		} else if len(l.entries) == 0 || l.commitIndex >= l.entries[len(l.entries)-1].index {
+			l.mutex.Unlock()
+			return nil
+		}
+		if l.committed == nil {
+			l.committed = make(chan struct{})
+		}
+		committed := l.committed
+		l.mutex.Unlock()
+
+		select {
+		case <-committed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Blocks until the entry at an index is committed or the context is done.
+// Returns an error if the entry is replaced by a leader or the log is closed
+// before it is committed, or the context's error if it is done first.
+// 每个等待者一个channel，commit时直接通知，不用轮询
+func (l *Log) WaitForCommit(ctx context.Context, index uint64) error {
+	l.mutex.Lock()
+	if l.writer == nil {
+		l.mutex.Unlock()
+		return errors.New("raft.Log: Log is not open")
+	} else if index <= l.commitIndex {
+		l.mutex.Unlock()
+		return nil
+	}
+	if l.commitWaiters == nil {
+		l.commitWaiters = make(map[uint64][]chan error)
+	}
+	c := make(chan error, 1)
+	l.commitWaiters[index] = append(l.commitWaiters[index], c)
+	l.mutex.Unlock()
+
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+		l.removeWaiter(index, c)
+		return ctx.Err()
+	}
+}
+
+// Sends a result to everything waiting on an index between from and to,
+// inclusive. The caller must hold the lock.
+func (l *Log) releaseWaiters(from, to uint64, err error) {
+	for index, waiters := range l.commitWaiters {
+		if index >= from && index <= to {
+			for _, c := range waiters {
+				c <- err
+			}
+			delete(l.commitWaiters, index)
+		}
+	}
+}
+
+// Stops waiting on an index after the waiter has given up.
+func (l *Log) removeWaiter(index uint64, c chan error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	waiters := l.commitWaiters[index]
+	for i, waiter := range waiters {
+		if waiter == c {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(l.commitWaiters, index)
+	} else {
+		l.commitWaiters[index] = waiters
+	}
+}
+
+// Writes entries up to the index to storage and updates the commit index.
+// Returns the entries that were committed. The caller must hold the lock.
+func (l *Log) writeCommitted(index uint64) ([]*LogEntry, error) {
+	// Do not allow previous indices to be committed again.
+	if index <= l.commitIndex && l.idempotentCommit {
+		return nil, nil
+	} else if index < l.commitIndex {
+		return nil, fmt.Errorf("raft.Log: Commit index (%d) ahead of requested commit index (%d)", l.commitIndex, index)
+	}
+
+	// Find all entries whose index is between the previous index and the current index.
+	var committed []*LogEntry
+	for _, entry := range l.entries {
+		if entry.index > l.commitIndex && entry.index <= index {
+			// Start a new file when the term changes.
+			if l.termFiles && !l.ephemeral && entry.term != l.fileTerm {
+				if err := l.openTermFile(entry.term); err != nil {
+					return committed, err
+				}
+			}
+
+			// Write to storage unless the log is in memory only.
+			if !l.ephemeral {
+				if err := entry.Encode(l.writer); err != nil {
+					return committed, err
+				}
+			}
+
+			// Update commit index.
+			l.commitIndex = entry.index
+			committed = append(committed, entry)
+		}
+	}
+
+	return committed, nil
+}
+
+// Registers a function to be called with each entry once it is committed.
+// Entries are passed in index order after they have been written to storage
+// and before SetCommitIndex returns. Callbacks are called in registration
+// order while the log is locked so they must not call back into the log.
+func (l *Log) OnCommit(fn func(*LogEntry)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.commitCallbacks = append(l.commitCallbacks, fn)
+}
+
+//--------------------------------------
+// Append
+//--------------------------------------
+
+// Writes a single log entry to the end of the log.
+func (l *Log) Append(entry *LogEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.appendEntry(entry)
+}
+
+// Decodes exactly n entries from a reader and appends them all at once. No
+// entries are appended if any of them fail to decode or are out of order. The
+// reader may be read past the last entry unless it is a *bufio.Reader.
+// 从网络流里直接decode出n个entry，一次加锁全部append
+func (l *Log) AppendBatchFromReader(r io.Reader, n int) ([]*LogEntry, error) {
+	reader := bufio.NewReader(r)
+	entries := make([]*LogEntry, 0, n)
+	for i := 0; i < n; i++ {
+		entry := NewLogEntry(l, 0, 0, nil)
+		if _, err := entry.Decode(reader); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := ValidateEntries(entries); err != nil {
+		return nil, err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Check the first entry against the end of the log before appending any.
+	if len(entries) > 0 && len(l.entries) > 0 {
+		if err := ValidateEntries([]*LogEntry{l.entries[len(l.entries)-1], entries[0]}); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range entries {
+		if err := l.appendEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// Appends entries received from a leader. Entries that the log already has
+// with the same term are skipped. At the first entry whose term differs, the
+// log is truncated and the remaining entries are appended in its place. It is
+// an error for the log to diverge at a committed entry.
+// 找分叉点、截断、追加在同一把锁里完成
+func (l *Log) AppendRange(entries []*LogEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.appendRange(entries)
+}
+
+// Appends entries received from a leader, truncating at the first divergent
+// entry. The caller must hold the lock.
+func (l *Log) appendRange(entries []*LogEntry) error {
+	if err := ValidateEntries(entries); err != nil {
+		return err
+	}
+
+	if l.writer == nil {
+		return errors.New("raft.Log: Log is not open")
+	}
+
+	// Skip entries already covered by the snapshot.
+	for len(entries) > 0 && entries[0].index <= l.compactIndex {
+		entries = entries[1:]
+	}
+
+	// Skip the prefix that matches the existing log.
+	for len(entries) > 0 {
+		i := l.search(entries[0].index)
+		if i == len(l.entries) {
+			break
+		} else if existing := l.entries[i]; existing.index != entries[0].index {
+			break
+		} else if existing.term != entries[0].term {
+			// Divergence: drop this entry and everything after it.
+			if existing.index <= l.commitIndex {
+				return fmt.Errorf("raft.Log: Cannot truncate committed entry (%x:%x)", existing.term, existing.index)
+			}
+			// Limit the capacity so appends don't overwrite entries still
+			// referenced by a snapshot.
+			l.entries = l.entries[:i:i]
+			l.releaseWaiters(existing.index, ^uint64(0), errors.New("raft.Log: Entry was replaced before it was committed"))
+			break
+		}
+		entries = entries[1:]
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	// The remaining entries must follow directly on from the last entry.
+	lastIndex := l.compactIndex
+	if len(l.entries) > 0 {
+		lastIndex = l.entries[len(l.entries)-1].index
+	}
+	if entries[0].index <= lastIndex {
+		return fmt.Errorf("raft.Log: Entry does not match any existing entry (%x:%x)", entries[0].term, entries[0].index)
+	} else if entries[0].index > lastIndex+1 {
+		return fmt.Errorf("raft.Log: Entry would leave a gap after index %x (%x:%x)", lastIndex, entries[0].term, entries[0].index)
+	}
+
+	for _, entry := range entries {
+		if err := l.appendEntry(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Applies an AppendEntries request from a leader to the log as a follower
+// would (Raft §5.3). The response is unsuccessful if the log does not contain
+// the request's previous entry. Otherwise conflicting entries are replaced,
+// new entries are appended and the commit index is advanced to the leader's
+// commit index, limited to the last entry in the request. The response term is
+// the request term; checking it against the current term is up to the server.
+// follower处理AppendEntries的全部log逻辑都在这一把锁里
+func (l *Log) AppendEntries(req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return nil, errors.New("raft.Log: Log is not open")
+	}
+	resp := &AppendEntriesResponse{Term: req.Term}
+
+	// The log must contain the entry preceding the new ones.
+	// Entries compacted into the snapshot are committed so they always match,
+	// apart from the last one whose term is saved with the snapshot.
+	prevIndex, prevTerm := uint64(req.PrevLogIndex), uint64(req.PrevLogTerm)
+	if i := l.search(prevIndex); i < len(l.entries) && l.entries[i].index == prevIndex {
+		if l.entries[i].term != prevTerm {
+			return resp, nil
+		}
+	} else if prevIndex == l.compactIndex && prevIndex > 0 {
+		if l.compactTerm != prevTerm {
+			return resp, nil
+		}
+	} else if prevIndex > l.compactIndex {
+		return resp, nil
+	}
+	if len(req.Entries) > 0 && req.Entries[0].index != prevIndex+1 {
+		return nil, fmt.Errorf("raft.Log: First entry (%x) does not follow previous log index (%x)", req.Entries[0].index, prevIndex)
+	}
+
+	if err := l.appendRange(req.Entries); err != nil {
+		return nil, err
+	}
+
+	// Commit up to the leader's commit index but no further than the
+	// entries this request has confirmed.
+	lastNewIndex := prevIndex
+	if len(req.Entries) > 0 {
+		lastNewIndex = req.Entries[len(req.Entries)-1].index
+	}
+	commitIndex := uint64(req.CommitIndex)
+	if commitIndex > lastNewIndex {
+		commitIndex = lastNewIndex
+	}
+	if commitIndex > l.commitIndex {
+		if err := l.setCommitIndex(commitIndex); err != nil {
+			return nil, err
+		}
+	}
+
+	resp.Success = true
+	return resp, nil
+}
+
+// Creates an entry for a command at the next index and appends it. Returns
+// the index assigned to the entry.
+// index由log自己分配，并发调用也不会出现空洞或重复
+func (l *Log) AppendNoIndex(term uint64, command Command) (uint64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	index := l.compactIndex + 1
+	if len(l.entries) > 0 {
+		index = l.entries[len(l.entries)-1].index + 1
+	}
+	if err := l.appendEntry(NewLogEntry(l, index, term, command)); err != nil {
+		return 0, err
+	}
+	return index, nil
+}
+
+// Writes a single log entry to the end of the log. The caller must hold the
+// lock.
+func (l *Log) appendEntry(entry *LogEntry) error {
+	if l.writer == nil {
+		return errors.New("raft.Log: Log is not open")
+	}
+
+	// Reject entries that could not be decoded when the log is reopened.
+	if !l.skipValidation {
+		if err := entry.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Entries up to the compaction point are already in the snapshot.
+	if entry.index <= l.compactIndex {
+		return fmt.Errorf("raft.Log: Cannot append entry at or before the snapshot (%x:%x <= %x:%x)", entry.term, entry.index, l.compactTerm, l.compactIndex)
+	}
+
+	// Make sure the term and index are greater than the previous.
+	if len(l.entries) > 0 {
+		lastEntry := l.entries[len(l.entries)-1]
+		if entry.term < lastEntry.term {
+			return fmt.Errorf("raft.Log: Cannot append entry with earlier term (%x:%x < %x:%x)", entry.term, entry.index, lastEntry.term, lastEntry.index)
+		} else if entry.index == lastEntry.index && entry.index <= lastEntry.index {
+			return fmt.Errorf("raft.Log: Cannot append entry with earlier index in the same term (%x:%x < %x:%x)", entry.term, entry.index, lastEntry.term, lastEntry.index)
+		}
+	}
+
+	// Append to entries list if stored on disk.
+	l.entries = append(l.entries, entry)
+
+	// Notify callbacks in order while still holding the lock, dropping any
+	// that time out so they are never called again.
+	callbacks := l.appendCallbacks[:0]
+	for _, fn := range l.appendCallbacks {
+		if l.appendCallbackTimeout <= 0 {
+			fn(entry)
+		} else if !callWithTimeout(fn, entry, l.appendCallbackTimeout) {
+			warn("raft.Log: Append callback timed out after %v; dropping it", l.appendCallbackTimeout)
+			continue
+		}
+		callbacks = append(callbacks, fn)
+	}
+	for i := len(callbacks); i < len(l.appendCallbacks); i++ {
+		l.appendCallbacks[i] = nil
+	}
+	l.appendCallbacks = callbacks
+
+	return nil
+}
+
+// Registers a function to be called with each entry after it is appended.
+// Callbacks are called in registration order while the log is locked so they
+// must not call back into the log. A callback that has not returned within the
+// append callback timeout is dropped and only finishes with the entry it was
+// called with.
+func (l *Log) OnAppend(fn func(*LogEntry)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.appendCallbacks = append(l.appendCallbacks, fn)
+}
+
+// Calls a callback with an entry and waits until it returns or the timeout
+// elapses, whichever is first. Returns false if the timeout elapsed.
+func callWithTimeout(fn func(*LogEntry), entry *LogEntry, timeout time.Duration) bool {
+	done := make(chan bool, 1)
+	go func() {
+		fn(entry)
+		done <- true
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+//--------------------------------------
+// Per-Term Files
+//--------------------------------------
+
+// Returns the path of the file that holds the entries for a term.
+func (l *Log) termPath(term uint64) string {
+	return fmt.Sprintf("%s-term-%d.log", strings.TrimSuffix(l.path, ".log"), term)
+}
+
+// Returns the terms that have a file on disk in ascending order.
+func (l *Log) terms() ([]uint64, error) {
+	prefix := strings.TrimSuffix(l.path, ".log") + "-term-"
+	matches, err := filepath.Glob(prefix + "*.log")
+	if err != nil {
+		return nil, err
+	}
+
+	var terms []uint64
+	for _, match := range matches {
+		var term uint64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(match, prefix), "%d.log", &term); err == nil {
+			terms = append(terms, term)
+		}
+	}
+	sort.Slice(terms, func(i, j int) bool { return terms[i] < terms[j] })
+	return terms, nil
+}
+
+// Reads the entries from every term file in term order and opens the latest
+// one for appending. The caller must hold the lock.
+// 按term从小到大依次读出所有文件，拼成l.entries
+func (l *Log) openTermFiles() error {
+	terms, err := l.terms()
+	if err != nil {
+		return err
+	}
+
+	for i, term := range terms {
+		truncated, err := l.readFile(l.termPath(term))
+		if err != nil {
+			return err
+		}
+
+		// Entries in later terms cannot follow a gap in an earlier one.
+		if truncated && i < len(terms)-1 {
+			return fmt.Errorf("raft.Log: Corrupt term file is followed by later terms: %s", l.termPath(term))
+		}
+	}
+
+	// Continue appending to the latest term.
+	l.fileTerm = 0
+	if len(terms) > 0 {
+		l.fileTerm = terms[len(terms)-1]
+	}
+	l.file, err = openLogFile(l.termPath(l.fileTerm))
+	return err
+}
+
+// Closes the current term file and opens the file for a new term. The current
+// file is removed if nothing was ever written to it. The caller must hold the
+// lock.
+func (l *Log) openTermFile(term uint64) error {
+	if err := l.flush(); err != nil {
+		return err
+	}
+	stat, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	if stat.Size() <= logHeaderSize {
+		os.Remove(l.termPath(l.fileTerm))
+	}
+
+	l.file, l.writer = nil, nil
+	if l.file, err = openLogFile(l.termPath(term)); err != nil {
+		return err
+	}
+	l.writer = l.fileWriter(l.file)
+	l.fileTerm = term
+	return nil
+}
+
+//--------------------------------------
+// Write-Ahead Log
+//--------------------------------------
+
+// Returns the path of the write-ahead log that sits next to the main log.
+func (l *Log) walPath() string {
+	return l.path + ".wal"
+}
+
+// Writes a single log entry to the write-ahead log. The entry is synced to disk
+// and durable once this returns but it is not added to the log entries or to the main log file
+// until it is committed with Commit().
+// WriteAhead只写.wal文件，不动l.entries和主log文件
+func (l *Log) WriteAhead(entry *LogEntry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return errors.New("raft.Log: Log is not open")
+	} else if !l.skipValidation {
+		if err := entry.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Make sure the term and index are greater than the previous entry,
+	// whether it is still in the write-ahead log or already in the log.
+	var lastEntry *LogEntry
+	if len(l.pending) > 0 {
+		lastEntry = l.pending[len(l.pending)-1]
+	} else if len(l.entries) > 0 {
+		lastEntry = l.entries[len(l.entries)-1]
+	}
+	if entry.index <= l.compactIndex {
+		return fmt.Errorf("raft.Log: Cannot write ahead entry at or before the snapshot (%x:%x <= %x:%x)", entry.term, entry.index, l.compactTerm, l.compactIndex)
+	} else if lastEntry != nil {
+		if entry.term < lastEntry.term {
+			return fmt.Errorf("raft.Log: Cannot write ahead entry with earlier term (%x:%x < %x:%x)", entry.term, entry.index, lastEntry.term, lastEntry.index)
+		} else if entry.index <= lastEntry.index {
+			return fmt.Errorf("raft.Log: Cannot write ahead entry with earlier index (%x:%x < %x:%x)", entry.term, entry.index, lastEntry.term, lastEntry.index)
+		}
+	}
+
+	// Lazily create the write-ahead log on first use.
+	if l.path == "" {
+		return errors.New("raft.Log: Write-ahead log requires a log file")
+	} else if l.walFile == nil {
+		var err error
+		if l.walFile, err = os.OpenFile(l.walPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err != nil {
+			return err
+		}
+	}
+	if err := entry.Encode(l.walFile); err != nil {
+		return err
+	} else if err := l.walFile.Sync(); err != nil {
+		return err
+	}
+	l.pending = append(l.pending, entry)
+
+	return nil
+}
+
+// Moves all write-ahead entries up to and including the given index into the
+// log and commits them to the main log file.
+func (l *Log) Commit(index uint64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return errors.New("raft.Log: Log is not open")
+	}
+
+	// Move committed entries from the write-ahead log to the log.
+	n := 0
+	for n < len(l.pending) && l.pending[n].index <= index {
+		if err := l.appendEntry(l.pending[n]); err != nil {
+			l.pending = l.pending[n:]
+			return err
+		}
+		n++
+	}
+	l.pending = l.pending[n:]
+
+	if err := l.setCommitIndex(index); err != nil {
+		return err
+	}
+
+	// Sync the main log before the write-ahead log drops its copy of the
+	// committed entries.
+	if l.file != nil && !l.ephemeral {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	// Rewrite the write-ahead log with only the remaining entries. If we crash
+	// before this then the committed entries are skipped on the next open.
+	return l.writeWAL()
+}
+
+// Reads any entries in the write-ahead log that did not make it into the main
+// log and keeps them pending. The caller must hold the lock.
+// 崩溃恢复：.wal里index大于commitIndex的entry就是还没commit的
+func (l *Log) openWAL() error {
+	path := l.walPath()
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	for {
+		if _, err := reader.Peek(1); err == io.EOF {
+			break
+		}
+
+		// A partially written entry at the end of the WAL was never
+		// acknowledged so it is safe to drop it.
+		entry := NewLogEntry(l, 0, 0, nil)
+		if _, err := entry.Decode(reader); err != nil {
+			warn("raft.Log: Write-ahead log: %v", err)
+			break
+		}
+
+		// Skip entries that are already in the main log.
+		if entry.index > l.commitIndex {
+			l.pending = append(l.pending, entry)
+		}
+	}
+	file.Close()
+
+	return l.writeWAL()
+}
+
+// Atomically replaces the write-ahead log with the pending entries and reopens
+// it for appending. The caller must hold the lock.
+func (l *Log) writeWAL() error {
+	if l.walFile != nil {
+		l.walFile.Close()
+		l.walFile = nil
+	}
+
+	// Remove the write-ahead log entirely if nothing is pending.
+	path := l.walPath()
+	if len(l.pending) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	// Write to a temporary file, sync it and swap it in so a crash leaves either
+	// the old or the new write-ahead log on disk.
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	for _, entry := range l.pending {
+		if err := entry.Encode(tmp); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	} else if err := syncDir(path); err != nil {
+		return err
+	}
+
+	l.walFile, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	return err
+}
+
+// Syncs the directory containing a path so a rename into it survives a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+//--------------------------------------
+// Compaction
+//--------------------------------------
+
+// Returns the path of the snapshot file that sits next to the main log.
+func (l *Log) snapshotPath() string {
+	return l.path + ".snap"
+}
+
+// Saves a snapshot of the state machine as of a committed index and then
+// removes the entries up to and including that index from the log. If the
+// process stops between the two steps then the next Open finishes removing
+// the entries.
+// 先落盘snapshot再截断log，中间崩溃由Open补完截断
+func (l *Log) Compact(index uint64, snapshot []byte) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.writer == nil {
+		return errors.New("raft.Log: Log is not open")
+	} else if l.path == "" {
+		return errors.New("raft.Log: Compaction requires a log file")
+	} else if l.termFiles {
+		return errors.New("raft.Log: Cannot compact per-term files")
+	} else if index > l.commitIndex {
+		return fmt.Errorf("raft.Log: Cannot compact uncommitted entries (%d > %d)", index, l.commitIndex)
+	}
+
+	// Save the term of the last compacted entry so followers can still match
+	// a previous entry at the snapshot index.
+	term := l.compactTerm
+	if i := l.search(index); i < len(l.entries) && l.entries[i].index == index {
+		term = l.entries[i].term
+	} else if index != l.compactIndex {
+		return fmt.Errorf("raft.Log: Entry not found: %d", index)
+	}
+
+	if err := l.writeSnapshot(index, term, snapshot); err != nil {
+		return err
+	}
+	l.compactIndex, l.compactTerm = index, term
+	return l.truncateBefore(index)
+}
+
+// Returns the index and contents of the snapshot saved by the last Compact.
+func (l *Log) LoadSnapshot() (uint64, []byte, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.path == "" {
+		return 0, nil, errors.New("raft.Log: Log path is unknown")
+	}
+	index, _, snapshot, err := readSnapshot(l.snapshotPath())
+	return index, snapshot, err
+}
+
+// Atomically replaces the snapshot file. The file holds the index and term of
+// the last compacted entry on the first line followed by the snapshot. The
+// caller must hold the lock.
+func (l *Log) writeSnapshot(index uint64, term uint64, snapshot []byte) error {
+	path := l.snapshotPath()
+	b := append([]byte(fmt.Sprintf("%016x %016x\n", index, term)), snapshot...)
+
+	// Sync the snapshot before it replaces the old one since the log entries
+	// it covers are removed right after.
+	tmp, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	} else if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(path)
+}
+
+// Reads the index, term and contents of a snapshot file.
+func readSnapshot(path string) (uint64, uint64, []byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var index, term uint64
+	if len(b) < 34 || b[33] != '\n' {
+		return 0, 0, nil, fmt.Errorf("raft.Log: Invalid snapshot file: %s", path)
+	} else if _, err := fmt.Sscanf(string(b[:33]), "%016x %016x", &index, &term); err != nil {
+		return 0, 0, nil, fmt.Errorf("raft.Log: Invalid snapshot file: %s: %v", path, err)
+	}
+	return index, term, b[34:], nil
+}
+
+// Reads the snapshot index, if there is a snapshot, and removes any entries
+// that an interrupted Compact left behind. The caller must hold the lock.
+func (l *Log) openSnapshot() error {
+	index, term, _, err := readSnapshot(l.snapshotPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if index >= l.compactIndex {
+		l.compactIndex, l.compactTerm = index, term
+	}
+	if index > l.commitIndex {
+		l.commitIndex = index
+	}
+	if len(l.entries) > 0 && l.entries[0].index <= index {
+		warn("raft.Log: Completing compaction (%d)", index)
+		return l.truncateBefore(index)
+	}
+	return nil
+}
+
+// Removes the entries up to and including an index and rewrites the log file
+// with the remaining committed entries. The caller must hold the lock.
+func (l *Log) truncateBefore(index uint64) error {
+	entries := l.entries[l.search(index+1):]
+	if err := l.rewriteFile(entries); err != nil {
+		return err
+	}
+
+	// Copy the entries so existing snapshots of the log are unaffected.
+	l.entries = append([]*LogEntry{}, entries...)
+	if index > l.compactIndex {
+		l.compactIndex = index
+	}
+	return nil
+}
+
+// Replaces the log file with the committed entries from a list. The caller
+// must hold the lock.
+func (l *Log) rewriteFile(entries []*LogEntry) error {
+	if err := l.flush(); err != nil {
+		return err
+	}
+
+	// Write to a temporary file, sync it and swap it in so a crash leaves
+	// either the old or the new log file on disk.
+	tmpPath := l.path + ".tmp"
+	os.Remove(tmpPath)
+	tmp, err := openLogFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.index > l.commitIndex {
+			break
+		} else if err := entry.Encode(tmp); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return err
+	} else if err := syncDir(l.path); err != nil {
+		return err
+	}
+
+	// Reopen the new file if the log is already open.
+	if l.file != nil {
+		l.file.Close()
+		if l.file, err = openLogFile(l.path); err != nil {
+			l.writer = nil
+			return err
+		}
+		l.writer = l.fileWriter(l.file)
+	}
+	return nil
+}
+
+//--------------------------------------
+// Disk Usage
+//--------------------------------------
+
+// Returns the total number of bytes used on disk by the log's files.
+func (l *Log) EstimatedDiskUsage() (int64, error) {
+	usage, err := l.DiskUsageStats()
+	return usage.Total, err
+}
+
+// Returns the number of bytes used on disk by each kind of file that belongs
+// to the log. Files that do not exist are counted as zero bytes.
+func (l *Log) DiskUsageStats() (DiskUsage, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var usage DiskUsage
+	if l.path == "" {
+		return usage, errors.New("raft.Log: Log path is unknown")
+	} else if err := l.flush(); err != nil {
+		return usage, err
+	}
+
+	// Sum up the sizes of a list of files, skipping missing files.
+	size := func(paths ...string) (int64, error) {
+		var n int64
+		for _, path := range paths {
+			stat, err := os.Stat(path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return 0, err
+			}
+			n += stat.Size()
+		}
+		return n, nil
+	}
+
+	logPaths := []string{l.path, l.walPath()}
+	if l.termFiles {
+		terms, err := l.terms()
+		if err != nil {
+			return usage, err
+		}
+		logPaths = []string{l.walPath()}
+		for _, term := range terms {
+			logPaths = append(logPaths, l.termPath(term))
+		}
+	}
+	archivePaths, err := l.archives()
+	if err != nil {
+		return usage, err
+	}
+
+	if usage.LogBytes, err = size(logPaths...); err != nil {
+		return usage, err
+	} else if usage.SnapshotBytes, err = size(l.snapshotPath()); err != nil {
+		return usage, err
+	} else if usage.IndexBytes, err = size(l.path + ".idx"); err != nil {
+		return usage, err
+	} else if usage.ArchiveBytes, err = size(archivePaths...); err != nil {
+		return usage, err
+	}
+	usage.Total = usage.LogBytes + usage.SnapshotBytes + usage.IndexBytes + usage.ArchiveBytes
+	return usage, nil
+}
+
+// Returns the paths of the files archived by Rotate().
+func (l *Log) archives() ([]string, error) {
+	matches, err := filepath.Glob(l.path + ".*.log")
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, match := range matches {
+		var timestamp int64
+		if _, err := fmt.Sscanf(strings.TrimPrefix(match, l.path+"."), "%d.log", &timestamp); err == nil {
+			paths = append(paths, match)
+		}
+	}
+	return paths, nil
+}
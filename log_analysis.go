@@ -0,0 +1,153 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A log analysis summarizes the entries of a log and records any anomalies
+// found in their indices.
+type LogAnalysis struct {
+	EntryCount          int
+	TermDistribution    map[uint64]int
+	CommandDistribution map[string]int
+	AverageEntrySize    float64
+	P99EntrySize        int
+	Gaps                []IndexRange
+	DuplicateIndices    []uint64
+}
+
+// An inclusive range of log indices.
+type IndexRange struct {
+	First uint64
+	Last  uint64
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Computes statistics about the entries of an open log and detects missing
+// and duplicate indices.
+// 统计term/command分布、entry大小，并检查index是否有空洞或重复
+func AnalyzeLog(log *Log) (*LogAnalysis, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if log.writer == nil {
+		return nil, errors.New("raft.Log: Log is not open")
+	}
+
+	a := &LogAnalysis{
+		EntryCount:          len(log.entries),
+		TermDistribution:    make(map[uint64]int),
+		CommandDistribution: make(map[string]int),
+	}
+	seen := make(map[uint64]bool)
+	sizes := make([]int, 0, len(log.entries))
+	total := 0
+	var prev *LogEntry
+	for _, entry := range log.entries {
+		a.TermDistribution[entry.term]++
+		if entry.command != nil {
+			a.CommandDistribution[entry.command.Name()]++
+		}
+
+		size := entry.Size()
+		sizes = append(sizes, size)
+		total += size
+
+		// Check the index against the previous entry.
+		if seen[entry.index] {
+			a.DuplicateIndices = append(a.DuplicateIndices, entry.index)
+		} else if prev != nil && entry.index > prev.index+1 {
+			a.Gaps = append(a.Gaps, IndexRange{First: prev.index + 1, Last: entry.index - 1})
+		}
+		seen[entry.index] = true
+		if prev == nil || entry.index > prev.index {
+			prev = entry
+		}
+	}
+
+	if len(sizes) > 0 {
+		sort.Ints(sizes)
+		a.AverageEntrySize = float64(total) / float64(len(sizes))
+		a.P99EntrySize = sizes[(len(sizes)*99+99)/100-1]
+	}
+
+	return a, nil
+}
+
+// Writes a human-readable report of an analysis.
+func FormatReport(a *LogAnalysis, w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "Entries: %d\nAverage entry size: %.1f bytes\nP99 entry size: %d bytes\n", a.EntryCount, a.AverageEntrySize, a.P99EntrySize); err != nil {
+		return err
+	}
+
+	// Write distributions in a stable order.
+	terms := make([]uint64, 0, len(a.TermDistribution))
+	for term := range a.TermDistribution {
+		terms = append(terms, term)
+	}
+	sort.Slice(terms, func(i, j int) bool { return terms[i] < terms[j] })
+	if _, err := fmt.Fprintln(w, "Terms:"); err != nil {
+		return err
+	}
+	for _, term := range terms {
+		if _, err := fmt.Fprintf(w, "  %d: %d\n", term, a.TermDistribution[term]); err != nil {
+			return err
+		}
+	}
+
+	names := make([]string, 0, len(a.CommandDistribution))
+	for name := range a.CommandDistribution {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if _, err := fmt.Fprintln(w, "Commands:"); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "  %s: %d\n", name, a.CommandDistribution[name]); err != nil {
+			return err
+		}
+	}
+
+	// Write anomalies.
+	if !a.HasAnomalies() {
+		_, err := fmt.Fprintln(w, "No anomalies found")
+		return err
+	}
+	for _, gap := range a.Gaps {
+		if _, err := fmt.Fprintf(w, "Missing indices: %d-%d\n", gap.First, gap.Last); err != nil {
+			return err
+		}
+	}
+	for _, index := range a.DuplicateIndices {
+		if _, err := fmt.Fprintf(w, "Duplicate index: %d\n", index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Returns true if any missing or duplicate indices were found.
+func (a *LogAnalysis) HasAnomalies() bool {
+	return len(a.Gaps) > 0 || len(a.DuplicateIndices) > 0
+}
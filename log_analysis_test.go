@@ -0,0 +1,74 @@
+package raft
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that a log analysis reports distributions and index anomalies.
+func TestAnalyzeLog(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if _, err := AnalyzeLog(log); err == nil {
+		t.Fatalf("Expected error analyzing a closed log")
+	}
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+
+	log.Append(NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}))
+	log.Append(NewLogEntry(log, 2, 1, &TestCommand2{100}))
+	log.Append(NewLogEntry(log, 5, 2, &TestCommand1{"bar", 0}))
+	log.Append(NewLogEntry(log, 6, 2, &TestCommand2{1}))
+	log.entries = append(log.entries, NewLogEntry(log, 6, 3, &TestCommand2{2}))
+
+	a, err := AnalyzeLog(log)
+	if err != nil {
+		t.Fatalf("Unable to analyze: %v", err)
+	}
+	if a.EntryCount != 5 {
+		t.Fatalf("Unexpected entry count: %d", a.EntryCount)
+	}
+	if !reflect.DeepEqual(a.TermDistribution, map[uint64]int{1: 2, 2: 2, 3: 1}) {
+		t.Fatalf("Unexpected term distribution: %v", a.TermDistribution)
+	}
+	if !reflect.DeepEqual(a.CommandDistribution, map[string]int{"cmd_1": 2, "cmd_2": 3}) {
+		t.Fatalf("Unexpected command distribution: %v", a.CommandDistribution)
+	}
+	if a.AverageEntrySize != 62.4 || a.P99EntrySize != 70 {
+		t.Fatalf("Unexpected entry sizes: %v, %v", a.AverageEntrySize, a.P99EntrySize)
+	}
+	if !reflect.DeepEqual(a.Gaps, []IndexRange{{3, 4}}) {
+		t.Fatalf("Unexpected gaps: %v", a.Gaps)
+	}
+	if !reflect.DeepEqual(a.DuplicateIndices, []uint64{6}) {
+		t.Fatalf("Unexpected duplicates: %v", a.DuplicateIndices)
+	}
+	if !a.HasAnomalies() {
+		t.Fatalf("Expected anomalies")
+	}
+
+	var buf bytes.Buffer
+	if err := FormatReport(a, &buf); err != nil {
+		t.Fatalf("Unable to format report: %v", err)
+	}
+	exp := "Entries: 5\nAverage entry size: 62.4 bytes\nP99 entry size: 70 bytes\n" +
+		"Terms:\n  1: 2\n  2: 2\n  3: 1\n" +
+		"Commands:\n  cmd_1: 2\n  cmd_2: 3\n" +
+		"Missing indices: 3-4\nDuplicate index: 6\n"
+	if buf.String() != exp {
+		t.Fatalf("Unexpected report:\nexp:\n%s\ngot:\n%s", exp, buf.String())
+	}
+}
@@ -0,0 +1,234 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+//
+// Setup
+//
+//------------------------------------------------------------------------------
+
+// A chaos mutator corrupts log files in ways a crash or a bad disk might.
+// Each mutation is chosen deterministically from a seed.
+type ChaosMutator struct{}
+
+// The outcome of opening a log after a single mutation. Offset is the first
+// byte of the file that the mutation changed.
+type RecoveryResult struct {
+	Mutation         string
+	Offset           int
+	Recovered        bool
+	Entries          int
+	RecoveredEntries []*LogEntry
+	Err              error
+}
+
+// Flips a random bit in the file.
+func (m ChaosMutator) FlipBit(path string, seed int64) error {
+	return m.mutate(path, seed, func(b []byte, r *rand.Rand) []byte {
+		if len(b) > 0 {
+			b[r.Intn(len(b))] ^= 1 << uint(r.Intn(8))
+		}
+		return b
+	})
+}
+
+// Truncates the file at a random offset.
+func (m ChaosMutator) TruncateRandom(path string, seed int64) error {
+	return m.mutate(path, seed, func(b []byte, r *rand.Rand) []byte {
+		return b[:r.Intn(len(b)+1)]
+	})
+}
+
+// Inserts n random bytes at a random offset.
+func (m ChaosMutator) InsertGarbage(path string, seed int64, n int) error {
+	return m.mutate(path, seed, func(b []byte, r *rand.Rand) []byte {
+		garbage := make([]byte, n)
+		r.Read(garbage)
+		i := r.Intn(len(b) + 1)
+		return append(b[:i:i], append(garbage, b[i:]...)...)
+	})
+}
+
+// Changes one hex digit in the checksum of a random entry.
+func (m ChaosMutator) CorruptChecksum(path string, seed int64) error {
+	return m.mutate(path, seed, func(b []byte, r *rand.Rand) []byte {
+		// Entries start after the header, if any, and after each newline.
+		starts := []int{0}
+		if bytes.HasPrefix(b, encodeHeader(CurrentFormatVersion)) {
+			starts[0] = logHeaderSize
+		}
+		for i, c := range b {
+			if c == '\n' && i+8 < len(b) {
+				starts = append(starts, i+1)
+			}
+		}
+		i := starts[r.Intn(len(starts))] + r.Intn(8)
+		if i < len(b) {
+			b[i] = hexDigits[(bytes.IndexByte([]byte(hexDigits), b[i])+1+r.Intn(len(hexDigits)-1))%len(hexDigits)]
+		}
+		return b
+	})
+}
+
+// Rewrites a file with a mutation of its contents.
+func (m ChaosMutator) mutate(path string, seed int64, fn func([]byte, *rand.Rand) []byte) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, fn(b, rand.New(rand.NewSource(seed))), 0600)
+}
+
+// Applies random mutations to a log file one at a time, opening the log after
+// each one and restoring the original file afterward. A panic while opening
+// fails the test. Logs are opened with the test command types registered.
+func ChaosTest(t testing.TB, path string, mutations int, seed int64) []RecoveryResult {
+	original, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read log: %v", err)
+	}
+	defer ioutil.WriteFile(path, original, 0600)
+
+	var m ChaosMutator
+	r := rand.New(rand.NewSource(seed))
+	results := make([]RecoveryResult, 0, mutations)
+	for i := 0; i < mutations; i++ {
+		s := r.Int63()
+		var result RecoveryResult
+		switch r.Intn(4) {
+		case 0:
+			result.Mutation, err = fmt.Sprintf("FlipBit(%d)", s), m.FlipBit(path, s)
+		case 1:
+			result.Mutation, err = fmt.Sprintf("TruncateRandom(%d)", s), m.TruncateRandom(path, s)
+		case 2:
+			result.Mutation, err = fmt.Sprintf("InsertGarbage(%d, 16)", s), m.InsertGarbage(path, s, 16)
+		case 3:
+			result.Mutation, err = fmt.Sprintf("CorruptChecksum(%d)", s), m.CorruptChecksum(path, s)
+		}
+		if err != nil {
+			t.Fatalf("Unable to apply %s: %v", result.Mutation, err)
+		}
+		mutated, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Unable to read log: %v", err)
+		}
+		for result.Offset < len(mutated) && result.Offset < len(original) && mutated[result.Offset] == original[result.Offset] {
+			result.Offset++
+		}
+
+		func() {
+			defer func() {
+				if v := recover(); v != nil {
+					t.Errorf("Panic opening log after %s: %v", result.Mutation, v)
+				}
+			}()
+			log := NewLog()
+			log.AddCommandType(&TestCommand1{})
+			log.AddCommandType(&TestCommand2{})
+			result.Err = log.Open(path)
+			result.Recovered = result.Err == nil
+			result.Entries = len(log.entries)
+			result.RecoveredEntries = log.entries
+			log.Close()
+		}()
+		results = append(results, result)
+
+		if err := ioutil.WriteFile(path, original, 0600); err != nil {
+			t.Fatalf("Unable to restore log: %v", err)
+		}
+	}
+	return results
+}
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that a log recovers to a prefix of its entries from random damage and
+// keeps every entry written before the damaged byte. Damage to the header may
+// instead fail Open.
+func TestLogChaos(t *testing.T) {
+	path := getLogPath()
+	defer os.Remove(path)
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	for i := uint64(1); i <= 100; i++ {
+		if i%2 == 0 {
+			log.Append(NewLogEntry(log, i, 1, &TestCommand1{"foo", int(i)}))
+		} else {
+			log.Append(NewLogEntry(log, i, 1, &TestCommand2{int(i)}))
+		}
+	}
+	log.SetCommitIndex(100)
+	entries := log.entries
+	log.Close()
+
+	// Find the offset at which each entry ends.
+	ends := make([]int, len(entries))
+	pos := logHeaderSize
+	for i, entry := range entries {
+		pos += entry.Size()
+		ends[i] = pos
+	}
+
+	recovered := 0
+	for _, result := range ChaosTest(t, path, 200, 1) {
+		if !result.Recovered {
+			if result.Offset >= logHeaderSize {
+				t.Fatalf("%s: Unable to recover from damage at offset %d: %v", result.Mutation, result.Offset, result.Err)
+			}
+			continue
+		}
+		recovered++
+
+		if result.Entries > len(entries) {
+			t.Fatalf("%s: Recovered more entries than were written: %d", result.Mutation, result.Entries)
+		}
+		for i, entry := range result.RecoveredEntries {
+			if !entry.Equal(entries[i]) {
+				t.Fatalf("%s: Recovered entry %d is not the original: %v != %v", result.Mutation, i, entry, entries[i])
+			}
+		}
+		intact := 0
+		for intact < len(ends) && ends[intact] <= result.Offset {
+			intact++
+		}
+		if result.Entries < intact {
+			t.Fatalf("%s: Lost entries before the damage at offset %d: recovered %d of %d", result.Mutation, result.Offset, result.Entries, intact)
+		}
+	}
+	if recovered == 0 {
+		t.Fatalf("Expected the log to recover from some mutations")
+	}
+
+	// Random mutations rarely land in the header so flip each of its bits too.
+	original, _ := ioutil.ReadFile(path)
+	defer ioutil.WriteFile(path, original, 0600)
+	for i := 0; i < logHeaderSize*8; i++ {
+		b := append([]byte{}, original...)
+		b[i/8] ^= 1 << uint(i%8)
+		ioutil.WriteFile(path, b, 0600)
+
+		log := NewLog()
+		log.AddCommandType(&TestCommand1{})
+		log.AddCommandType(&TestCommand2{})
+		if err := log.Open(path); err == nil && len(log.entries) != len(entries) {
+			t.Fatalf("Flipping header bit %d lost entries: recovered %d of %d", i, len(log.entries), len(entries))
+		}
+		log.Close()
+	}
+}
@@ -0,0 +1,149 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// A diff result describes how two log files differ. CommonPrefix is the index
+// of the last entry before the first difference. Entries at the same index
+// with different terms or commands are conflicting.
+type DiffResult struct {
+	PathA        string
+	PathB        string
+	CommonPrefix uint64
+	OnlyInA      []*LogEntry
+	OnlyInB      []*LogEntry
+	Conflicting  []EntryPair
+}
+
+// A pair of entries at the same index in two logs.
+type EntryPair struct {
+	A *LogEntry
+	B *LogEntry
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Compares the entries of two log files by index. The files are only read,
+// so this is safe to use on the logs of running nodes.
+// 排查集群分叉：找出两个节点的log从哪里开始不一样
+func Diff(pathA, pathB string, commandTypes map[string]Command) (*DiffResult, error) {
+	a, err := readLogFile(pathA, commandTypes)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readLogFile(pathB, commandTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &DiffResult{PathA: pathA, PathB: pathB}
+	diverged := false
+	for i, j := 0, 0; i < len(a) || j < len(b); {
+		switch {
+		case j == len(b) || (i < len(a) && a[i].index < b[j].index):
+			r.OnlyInA = append(r.OnlyInA, a[i])
+			diverged = true
+			i++
+		case i == len(a) || b[j].index < a[i].index:
+			r.OnlyInB = append(r.OnlyInB, b[j])
+			diverged = true
+			j++
+		default:
+			if !a[i].Equal(b[j]) {
+				r.Conflicting = append(r.Conflicting, EntryPair{A: a[i], B: b[j]})
+				diverged = true
+			} else if !diverged {
+				r.CommonPrefix = a[i].index
+			}
+			i++
+			j++
+		}
+	}
+	return r, nil
+}
+
+// Writes a diff result in the style of a unified diff, with entries only in
+// the first log prefixed by "-" and entries only in the second by "+".
+func FormatDiff(r *DiffResult, w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "--- %s\n+++ %s\n@@ common prefix through index %d @@\n", r.PathA, r.PathB, r.CommonPrefix); err != nil {
+		return err
+	}
+
+	// Write the differences in index order.
+	i, j, k := 0, 0, 0
+	for i < len(r.OnlyInA) || j < len(r.OnlyInB) || k < len(r.Conflicting) {
+		index := ^uint64(0)
+		if i < len(r.OnlyInA) && r.OnlyInA[i].index < index {
+			index = r.OnlyInA[i].index
+		}
+		if j < len(r.OnlyInB) && r.OnlyInB[j].index < index {
+			index = r.OnlyInB[j].index
+		}
+		if k < len(r.Conflicting) && r.Conflicting[k].A.index < index {
+			index = r.Conflicting[k].A.index
+		}
+
+		var err error
+		switch {
+		case i < len(r.OnlyInA) && r.OnlyInA[i].index == index:
+			err = writeDiffLine(w, "-", r.OnlyInA[i])
+			i++
+		case j < len(r.OnlyInB) && r.OnlyInB[j].index == index:
+			err = writeDiffLine(w, "+", r.OnlyInB[j])
+			j++
+		default:
+			if err = writeDiffLine(w, "-", r.Conflicting[k].A); err == nil {
+				err = writeDiffLine(w, "+", r.Conflicting[k].B)
+			}
+			k++
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes an encoded entry preceded by a prefix.
+func writeDiffLine(w io.Writer, prefix string, entry *LogEntry) error {
+	var b bytes.Buffer
+	if err := entry.Encode(&b); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s%s", prefix, b.String())
+	return err
+}
+
+// Decodes every entry of a log file without opening it for writing.
+func readLogFile(path string, commandTypes map[string]Command) ([]*LogEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	l := &Log{commandTypes: commandTypes, checksumInterval: 1}
+	if _, _, err := readHeader(reader); err != nil {
+		return nil, err
+	}
+	if _, err := l.decodeEntries(reader); err != nil {
+		return nil, fmt.Errorf("raft.Log: %s: %v", path, err)
+	}
+	return l.entries, nil
+}
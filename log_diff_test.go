@@ -0,0 +1,76 @@
+package raft
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that two logs that diverge at index 500 are compared correctly.
+func TestDiff(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+
+	// The second log has a different leader's entries after index 500 and
+	// also has the v1 header.
+	var a, b bytes.Buffer
+	b.WriteString(testHeader)
+	for i := uint64(1); i <= 600; i++ {
+		MakeEntry(log, i, 1, "test", "foo").Encode(&a)
+		if i <= 500 {
+			MakeEntry(log, i, 1, "test", "foo").Encode(&b)
+		} else if i <= 550 {
+			MakeEntry(log, i, 2, "test", "bar").Encode(&b)
+		}
+	}
+	pathA, pathB := setupLog(a.String()), setupLog(b.String())
+	defer os.Remove(pathA)
+	defer os.Remove(pathB)
+
+	r, err := Diff(pathA, pathB, log.commandTypes)
+	if err != nil {
+		t.Fatalf("Unable to diff: %v", err)
+	}
+	if r.CommonPrefix != 500 {
+		t.Fatalf("Unexpected common prefix: %d", r.CommonPrefix)
+	}
+	if len(r.Conflicting) != 50 || r.Conflicting[0].A.index != 501 || r.Conflicting[0].B.term != 2 {
+		t.Fatalf("Unexpected conflicting entries: %d", len(r.Conflicting))
+	}
+	if len(r.OnlyInA) != 50 || r.OnlyInA[0].index != 551 || len(r.OnlyInB) != 0 {
+		t.Fatalf("Unexpected entries only in one log: %d, %d", len(r.OnlyInA), len(r.OnlyInB))
+	}
+
+	var buf bytes.Buffer
+	if err := FormatDiff(r, &buf); err != nil {
+		t.Fatalf("Unable to format: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3+50*2+50 {
+		t.Fatalf("Unexpected line count: %d", len(lines))
+	}
+	if lines[2] != "@@ common prefix through index 500 @@" ||
+		!strings.HasPrefix(lines[3], "-") || !strings.Contains(lines[3], " 00000000000001f5 0000000000000001 ") ||
+		!strings.HasPrefix(lines[4], "+") || !strings.Contains(lines[4], " 00000000000001f5 0000000000000002 ") {
+		t.Fatalf("Unexpected diff:\n%s", strings.Join(lines[:5], "\n"))
+	}
+}
+
+// Ensure that a corrupt log cannot be compared.
+func TestDiffCorrupt(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	pathA, pathB := setupLog(""), setupLog("00000000 bad\n")
+	defer os.Remove(pathA)
+	defer os.Remove(pathB)
+	if _, err := Diff(pathA, pathB, log.commandTypes); err == nil {
+		t.Fatalf("Expected error for corrupt log")
+	}
+}
@@ -10,6 +10,14 @@ import (
 	"encoding/json"
 )
 
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+const hexDigits = "0123456789abcdef"
+
 //------------------------------------------------------------------------------
 //
 // Typedefs
@@ -22,6 +30,27 @@ type LogEntry struct {
 	index   uint64
 	term    uint64
 	command Command
+	size    int
+}
+
+// An error returned by ValidateEntries for the first entry that does not
+// follow the previous entry. AtIndex is the position in the slice.
+type ErrEntryOrderViolation struct {
+	AtIndex int
+	Entry   *LogEntry
+	Prev    *LogEntry
+}
+
+// An error returned when a fully decoded entry fails validation. Unlike a
+// partially written entry it cannot be recovered by truncating the log.
+type ErrInvalidEntry struct {
+	Err error
+}
+
+// An error returned when decoding an entry panics, such as when a command's
+// JSON decoder panics on malformed input.
+type ErrDecodePanic struct {
+	Recovered interface{}
 }
 
 //------------------------------------------------------------------------------
@@ -40,12 +69,140 @@ func NewLogEntry(log *Log, index uint64, term uint64, command Command) *LogEntry
 	}
 }
 
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Checks that a list of entries is in order before any of them are applied to
+// a log. Indices must be strictly increasing and terms must not decrease.
+// follower在写log之前先检查leader发来的entries是否有序
+func ValidateEntries(entries []*LogEntry) error {
+	for i, entry := range entries {
+		if entry == nil {
+			return ErrEntryOrderViolation{AtIndex: i}
+		} else if i == 0 {
+			continue
+		}
+
+		prev := entries[i-1]
+		if entry.index <= prev.index || entry.term < prev.term {
+			return ErrEntryOrderViolation{AtIndex: i, Entry: entry, Prev: prev}
+		}
+	}
+	return nil
+}
+
 //------------------------------------------------------------------------------
 //
 // Methods
 //
 //------------------------------------------------------------------------------
 
+//--------------------------------------
+// Errors
+//--------------------------------------
+
+func (e ErrEntryOrderViolation) Error() string {
+	if e.Entry == nil {
+		return fmt.Sprintf("raft.LogEntry: Missing entry at position %d", e.AtIndex)
+	}
+	return fmt.Sprintf("raft.LogEntry: Entry out of order at position %d (%x:%x after %x:%x)", e.AtIndex, e.Entry.term, e.Entry.index, e.Prev.term, e.Prev.index)
+}
+
+func (e ErrInvalidEntry) Error() string {
+	return e.Err.Error()
+}
+
+func (e ErrDecodePanic) Error() string {
+	return fmt.Sprintf("raft.LogEntry: Panic while decoding: %v", e.Recovered)
+}
+
+//--------------------------------------
+// Command Types
+//--------------------------------------
+
+// Returns true if the entry is the no-op entry a leader commits at the start
+// of its term. State machines should skip these entries.
+func (e *LogEntry) IsNoOp() bool {
+	return e.command != nil && e.command.Name() == NoOpCommandName
+}
+
+// Returns true if the entry changes the cluster configuration. State machines
+// should skip these entries.
+func (e *LogEntry) IsConfigChange() bool {
+	return e.command != nil && e.command.Name() == ConfigChangeCommandName
+}
+
+//--------------------------------------
+// Comparison
+//--------------------------------------
+
+// Returns true if both entries have the same index, term and JSON encoded
+// command. Commands are compared by their serialized form only so commands of
+// different types that encode to the same JSON are considered equal.
+func (e *LogEntry) Equal(other *LogEntry) bool {
+	if e == nil || other == nil {
+		return e == other
+	} else if e.index != other.index || e.term != other.term {
+		return false
+	}
+
+	a, err := json.Marshal(e.command)
+	if err != nil {
+		return false
+	}
+	b, err := json.Marshal(other.command)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a, b)
+}
+
+//--------------------------------------
+// Validation
+//--------------------------------------
+
+// Checks that the entry is consistent: the index and term are set, the
+// command is registered with the entry's log and the command's JSON encoding
+// survives a roundtrip unchanged. The entry is not modified.
+// Decode之后会自动调用，手动构造的entry也可以在Append之前检查
+func (e *LogEntry) Validate() error {
+	if e.index == 0 {
+		return errors.New("raft.LogEntry: Index must be greater than zero")
+	} else if e.term == 0 {
+		return errors.New("raft.LogEntry: Term must be greater than zero")
+	} else if e.command == nil {
+		return errors.New("raft.LogEntry: Command required")
+	} else if e.command.Name() == "" {
+		return errors.New("raft.LogEntry: Command name required")
+	} else if e.log == nil {
+		return errors.New("raft.LogEntry: Log required to validate command")
+	}
+
+	// Decode the encoded command into a fresh copy and encode it again.
+	copy, err := e.log.NewCommand(e.command.Name())
+	if err != nil {
+		return fmt.Errorf("raft.LogEntry: %v", err)
+	}
+	a, err := json.Marshal(e.command)
+	if err != nil {
+		return fmt.Errorf("raft.LogEntry: Unable to encode command: %v", err)
+	}
+	if err := json.Unmarshal(a, &copy); err != nil {
+		return fmt.Errorf("raft.LogEntry: Unable to decode command: %v", err)
+	}
+	b, err := json.Marshal(copy)
+	if err != nil {
+		return fmt.Errorf("raft.LogEntry: Unable to encode command: %v", err)
+	}
+	if !bytes.Equal(a, b) {
+		return fmt.Errorf("raft.LogEntry: Command does not roundtrip: %s != %s", a, b)
+	}
+	return nil
+}
+
 //--------------------------------------
 // Encoding
 //--------------------------------------
@@ -81,11 +238,92 @@ func (e *LogEntry) Encode(w io.Writer) error {
 	return err
 }
 
+// Encodes the log entry by appending it to a buffer. This avoids the temporary
+// buffer used by Encode so multiple entries can be encoded into a single
+// buffer and written out in one call. The buffer is left unchanged on error.
+// 先写入checksum的占位符，整行写完后再原地填上checksum
+func (e *LogEntry) EncodeInto(buf *bytes.Buffer) error {
+	if buf == nil {
+		return errors.New("raft.LogEntry: Buffer required to encode")
+	}
+	start := buf.Len()
+
+	// Write a placeholder checksum followed by the log line. The JSON encoder
+	// terminates the command with a newline.
+	buf.WriteString("00000000 ")
+	if _, err := fmt.Fprintf(buf, "%016x %016x %s ", e.index, e.term, e.command.Name()); err != nil {
+		buf.Truncate(start)
+		return err
+	}
+	if err := json.NewEncoder(buf).Encode(e.command); err != nil {
+		buf.Truncate(start)
+		return err
+	}
+
+	// Generate checksum and write it over the placeholder.
+	b := buf.Bytes()[start:]
+	checksum := crc32.ChecksumIEEE(b[9:])
+	for i := 7; i >= 0; i-- {
+		b[i] = hexDigits[checksum&0xF]
+		checksum >>= 4
+	}
+
+	return nil
+}
+
+// Encodes the log entry as a JSON string containing the encoded log line.
+func (e *LogEntry) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	if err := e.EncodeInto(&b); err != nil {
+		return nil, err
+	}
+	return json.Marshal(b.String())
+}
+
+// Returns the number of bytes the entry takes up when encoded. The result is
+// cached after the first call so the command should not change afterward.
+// Returns zero if the command cannot be encoded.
+// 不用真正Encode就能算出长度：
+// checksum(8) + 空格 + index(16) + 空格 + term(16) + 空格 + name + 空格 + json + 换行
+func (e *LogEntry) Size() int {
+	size, _ := e.encodedSize()
+	return size
+}
+
+// Returns the encoded size of the entry, caching it on success.
+func (e *LogEntry) encodedSize() (int, error) {
+	if e.size > 0 {
+		return e.size, nil
+	} else if e.command == nil {
+		return 0, errors.New("raft.LogEntry: Command required to encode")
+	}
+
+	encodedCommand, err := json.Marshal(e.command)
+	if err != nil {
+		return 0, err
+	}
+	e.size = 9 + 17 + 17 + len(e.command.Name()) + 1 + len(encodedCommand) + 1
+	return e.size, nil
+}
+
 // Decodes the log entry from a buffer. Returns the number of bytes read.
 // 从log中把log entry恢复出来，并返回本次读了多少byte
 func (e *LogEntry) Decode(r io.Reader) (pos int, err error) {
+	return e.decode(r, true)
+}
+
+// Decodes the log entry from a buffer, optionally skipping verification of
+// the checksum. Returns the number of bytes read.
+func (e *LogEntry) decode(r io.Reader, verify bool) (pos int, err error) {
 	pos = 0
 
+	// A corrupt log should fail to open rather than crash the process.
+	defer func() {
+		if v := recover(); v != nil {
+			err = ErrDecodePanic{Recovered: v}
+		}
+	}()
+
 	if r == nil {
 		err = errors.New("raft.LogEntry: Reader required to decode")
 		return
@@ -120,10 +358,12 @@ func (e *LogEntry) Decode(r io.Reader) (pos int, err error) {
 	b := bytes.NewBufferString(line)
 
 	// Verify checksum.
-	bchecksum := crc32.ChecksumIEEE(b.Bytes())
-	if checksum != bchecksum {
-		err = fmt.Errorf("raft.LogEntry: Invalid checksum: Expected %08x, calculated %08x", checksum, bchecksum)
-		return
+	if verify {
+		bchecksum := crc32.ChecksumIEEE(b.Bytes())
+		if checksum != bchecksum {
+			err = fmt.Errorf("raft.LogEntry: Invalid checksum: Expected %08x, calculated %08x", checksum, bchecksum)
+			return
+		}
 	}
 
 	// Read term, index and command name.
@@ -156,5 +396,10 @@ func (e *LogEntry) Decode(r io.Reader) (pos int, err error) {
 	}
 
 	err = nil
+	if !e.log.skipValidation {
+		if verr := e.Validate(); verr != nil {
+			err = ErrInvalidEntry{Err: verr}
+		}
+	}
 	return
 }
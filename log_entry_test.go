@@ -0,0 +1,286 @@
+package raft
+
+import (
+	"bytes"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that the calculated size matches the encoded byte count.
+func TestLogEntrySize(t *testing.T) {
+	log := NewLog()
+	entries := []*LogEntry{
+		NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}),
+		NewLogEntry(log, 2, 1, &TestCommand2{100}),
+		NewLogEntry(log, 0xFFFFFFFFFFFFFFFF, 0xFFFFFFFFFFFFFFFF, &TestCommand1{"", -5}),
+	}
+	for i, entry := range entries {
+		var b bytes.Buffer
+		if err := entry.Encode(&b); err != nil {
+			t.Fatalf("Unable to encode entry[%d]: %v", i, err)
+		}
+		if size := entry.Size(); size != b.Len() {
+			t.Fatalf("Unexpected size for entry[%d]: exp %d, got %d", i, b.Len(), size)
+		}
+		if size := entry.Size(); size != b.Len() {
+			t.Fatalf("Unexpected cached size for entry[%d]: exp %d, got %d", i, b.Len(), size)
+		}
+	}
+}
+
+// Ensure that encoding into a buffer matches the regular encoding.
+func TestLogEntryEncodeInto(t *testing.T) {
+	log := NewLog()
+	var exp, buf bytes.Buffer
+	buf.WriteString("prefix ")
+	exp.WriteString("prefix ")
+	for i := 0; i < 3; i++ {
+		entry := NewLogEntry(log, uint64(i+1), 1, &TestCommand1{"<foo>", i})
+		if err := entry.Encode(&exp); err != nil {
+			t.Fatalf("Unable to encode: %v", err)
+		}
+		if err := entry.EncodeInto(&buf); err != nil {
+			t.Fatalf("Unable to encode into buffer: %v", err)
+		}
+	}
+	if buf.String() != exp.String() {
+		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", exp.String(), buf.String())
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Benchmarks
+//
+//------------------------------------------------------------------------------
+
+func BenchmarkLogEntryEncode(b *testing.B) {
+	log := NewLog()
+	entries := make([]*LogEntry, 100)
+	for i := range entries {
+		entries[i] = NewLogEntry(log, uint64(i+1), 1, &TestCommand1{"foo", i})
+	}
+
+	b.Run("Encode", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			for _, entry := range entries {
+				entry.Encode(&buf)
+			}
+		}
+	})
+	b.Run("EncodeInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf bytes.Buffer
+		for i := 0; i < b.N; i++ {
+			buf.Reset()
+			for _, entry := range entries {
+				entry.EncodeInto(&buf)
+			}
+		}
+	})
+}
+
+type TestCommand3 struct {
+	X int `json:"x"`
+}
+
+func (c TestCommand3) Name() string {
+	return "cmd_3"
+}
+
+// Ensure that entries are compared by index, term and encoded command.
+func TestLogEntryEqual(t *testing.T) {
+	log := NewLog()
+	tests := []struct {
+		a, b  *LogEntry
+		equal bool
+	}{
+		{NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}), NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}), true},
+		{NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}), NewLogEntry(log, 1, 1, &TestCommand1{"foo", 21}), false},
+		{NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}), NewLogEntry(log, 2, 1, &TestCommand1{"foo", 20}), false},
+		{NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}), NewLogEntry(log, 1, 2, &TestCommand1{"foo", 20}), false},
+		{NewLogEntry(log, 1, 1, &TestCommand2{100}), NewLogEntry(log, 1, 1, &TestCommand3{100}), true},
+		{NewLogEntry(log, 1, 1, nil), NewLogEntry(log, 1, 1, nil), true},
+		{NewLogEntry(log, 1, 1, nil), NewLogEntry(log, 1, 1, &TestCommand2{100}), false},
+		{NewLogEntry(log, 1, 1, nil), nil, false},
+		{nil, nil, true},
+	}
+	for i, tt := range tests {
+		if equal := tt.a.Equal(tt.b); equal != tt.equal {
+			t.Fatalf("%d. Unexpected equality: exp %v, got %v", i, tt.equal, equal)
+		}
+		if equal := tt.b.Equal(tt.a); equal != tt.equal {
+			t.Fatalf("%d. Unexpected reverse equality: exp %v, got %v", i, tt.equal, equal)
+		}
+	}
+}
+
+type testNoOpCommand struct{}
+
+func (c testNoOpCommand) Name() string {
+	return NoOpCommandName
+}
+
+type testConfigChangeCommand struct{}
+
+func (c testConfigChangeCommand) Name() string {
+	return ConfigChangeCommandName
+}
+
+// Ensure that internal entries can be identified and skipped by a state machine.
+func TestLogEntryIsNoOp(t *testing.T) {
+	log := NewLog()
+	entries := []*LogEntry{
+		NewLogEntry(log, 1, 1, &testNoOpCommand{}),
+		NewLogEntry(log, 2, 1, &TestCommand2{100}),
+		NewLogEntry(log, 3, 1, &testConfigChangeCommand{}),
+		NewLogEntry(log, 4, 1, nil),
+	}
+	if !entries[0].IsNoOp() || entries[0].IsConfigChange() {
+		t.Fatalf("Expected entry[0] to be a no-op")
+	}
+	if entries[1].IsNoOp() || entries[1].IsConfigChange() {
+		t.Fatalf("Expected entry[1] to be a regular command")
+	}
+	if entries[2].IsNoOp() || !entries[2].IsConfigChange() {
+		t.Fatalf("Expected entry[2] to be a configuration change")
+	}
+	if entries[3].IsNoOp() || entries[3].IsConfigChange() {
+		t.Fatalf("Expected entry[3] to be a regular entry")
+	}
+
+	// Apply only the state machine commands.
+	var applied []uint64
+	for _, entry := range entries[:3] {
+		if !entry.IsNoOp() && !entry.IsConfigChange() {
+			applied = append(applied, entry.index)
+		}
+	}
+	if len(applied) != 1 || applied[0] != 2 {
+		t.Fatalf("Unexpected applied entries: %v", applied)
+	}
+}
+
+// Ensure that out of order entries are rejected.
+func TestValidateEntries(t *testing.T) {
+	log := NewLog()
+	e1 := NewLogEntry(log, 1, 1, &TestCommand2{1})
+	e2 := NewLogEntry(log, 2, 1, &TestCommand2{2})
+	e3 := NewLogEntry(log, 3, 2, &TestCommand2{3})
+	e3early := NewLogEntry(log, 3, 0, &TestCommand2{3})
+	tests := []struct {
+		entries []*LogEntry
+		err     error
+	}{
+		{nil, nil},
+		{[]*LogEntry{e1}, nil},
+		{[]*LogEntry{e1, e2, e3}, nil},
+		{[]*LogEntry{e1, e3, e2}, ErrEntryOrderViolation{AtIndex: 2, Entry: e2, Prev: e3}},
+		{[]*LogEntry{e1, e2, e2}, ErrEntryOrderViolation{AtIndex: 2, Entry: e2, Prev: e2}},
+		{[]*LogEntry{e1, e2, e3early}, ErrEntryOrderViolation{AtIndex: 2, Entry: e3early, Prev: e2}},
+		{[]*LogEntry{e1, nil}, ErrEntryOrderViolation{AtIndex: 1}},
+	}
+	for i, tt := range tests {
+		if err := ValidateEntries(tt.entries); err != tt.err {
+			t.Fatalf("%d. Unexpected error: exp %v, got %v", i, tt.err, err)
+		}
+	}
+}
+
+type testEmptyNameCommand struct{}
+
+func (c *testEmptyNameCommand) Name() string {
+	return ""
+}
+
+// Ensure that inconsistent entries fail validation.
+func TestLogEntryValidate(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+
+	if err := MakeEntry(log, 1, 1, "test", "foo").Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i, entry := range []*LogEntry{
+		MakeEntry(log, 0, 1, "test", "foo"),
+		MakeEntry(log, 1, 0, "test", "foo"),
+		NewLogEntry(log, 1, 1, nil),
+		NewLogEntry(log, 1, 1, &testEmptyNameCommand{}),
+		MakeEntry(log, 1, 1, "foo", "foo"),
+		MakeEntry(nil, 1, 1, "test", "foo"),
+	} {
+		if err := entry.Validate(); err == nil {
+			t.Fatalf("%d. Expected validation error: %v", i, entry)
+		}
+	}
+}
+
+// Ensure that decoded entries are validated unless validation is skipped.
+func TestLogEntryDecodeValidate(t *testing.T) {
+	var buf bytes.Buffer
+	MakeEntry(nil, 1, 0, "test", "foo").Encode(&buf)
+	encoded := buf.String()
+
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if _, err := NewLogEntry(log, 0, 0, nil).Decode(bytes.NewBufferString(encoded)); err == nil {
+		t.Fatalf("Expected validation error for zero term")
+	}
+
+	log = NewLog(WithSkipValidation(true))
+	MustRegisterTestCommand(log, "test")
+	if _, err := NewLogEntry(log, 0, 0, nil).Decode(bytes.NewBufferString(encoded)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+type testPanicCommand struct{}
+
+func (c *testPanicCommand) Name() string {
+	return "panic"
+}
+
+func (c *testPanicCommand) UnmarshalJSON([]byte) error {
+	panic("malformed")
+}
+
+// Ensure that a panic while decoding a command is returned as an error.
+func TestLogEntryDecodePanic(t *testing.T) {
+	log := NewLog()
+	log.AddCommandType(&testPanicCommand{})
+	var buf bytes.Buffer
+	NewLogEntry(log, 1, 1, &testPanicCommand{}).Encode(&buf)
+
+	_, err := NewLogEntry(log, 0, 0, nil).Decode(&buf)
+	if err, ok := err.(ErrDecodePanic); !ok || err.Recovered != "malformed" {
+		t.Fatalf("Expected ErrDecodePanic: %v", err)
+	}
+}
+
+// Ensure that no input causes Decode to panic.
+func FuzzLogEntryDecode(f *testing.F) {
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	for _, entry := range []*LogEntry{
+		NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}),
+		NewLogEntry(log, 2, 1, &TestCommand2{100}),
+	} {
+		var buf bytes.Buffer
+		entry.Encode(&buf)
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte("00000000 \n"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		NewLogEntry(log, 0, 0, nil).Decode(bytes.NewReader(b))
+	})
+}
@@ -0,0 +1,115 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The format version written to the header of new log files. Version 0 is the
+// original format, which has no header.
+const CurrentFormatVersion uint16 = 1
+
+// The magic number at the start of a log file header ("RAFT").
+const logMagic uint32 = 0x52414654
+
+// The size of a log file header: the magic number followed by the version.
+const logHeaderSize = 6
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An error returned by Open when a log file was written with a format version
+// that this package cannot read.
+type ErrUnsupportedLogVersion struct {
+	Got uint16
+	Max uint16
+}
+
+//------------------------------------------------------------------------------
+//
+// Functions
+//
+//------------------------------------------------------------------------------
+
+// Encodes the header for a log file of the given format version.
+func encodeHeader(version uint16) []byte {
+	b := make([]byte, logHeaderSize)
+	binary.BigEndian.PutUint32(b[0:4], logMagic)
+	binary.BigEndian.PutUint16(b[4:6], version)
+	return b
+}
+
+// Reads the header from the start of a log file. An empty file or one that
+// starts with a checksum is version 0 and nothing is read from it. Anything
+// else is a damaged header rather than a version 0 entry, since treating it
+// as an entry would truncate the whole file. Returns the format version and
+// the number of bytes read.
+// 旧文件没有header，第一个字节是checksum的十六进制字符，不会跟"RAFT"混淆
+func readHeader(reader *bufio.Reader) (uint16, int, error) {
+	magic, _ := reader.Peek(4)
+	if len(magic) == 0 || isHexDigit(magic[0]) {
+		return 0, 0, nil
+	} else if !bytes.Equal(magic, encodeHeader(0)[0:4]) {
+		return 0, 0, fmt.Errorf("raft.Log: Invalid log header: %q", magic)
+	}
+
+	b := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return 0, 0, fmt.Errorf("raft.Log: Unable to read header: %v", err)
+	}
+	version := binary.BigEndian.Uint16(b[4:6])
+	if version == 0 || version > CurrentFormatVersion {
+		return version, logHeaderSize, ErrUnsupportedLogVersion{Got: version, Max: CurrentFormatVersion}
+	}
+	return version, logHeaderSize, nil
+}
+
+// Returns true if a byte is a lowercase hex digit, as written by Encode.
+func isHexDigit(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')
+}
+
+// Opens a log file for appending. A header is written if the file is new so
+// existing version 0 files stay headerless.
+func openLogFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		if _, err := file.Write(encodeHeader(CurrentFormatVersion)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+func (e ErrUnsupportedLogVersion) Error() string {
+	return fmt.Sprintf("raft.Log: Unsupported log format version %d (max %d)", e.Got, e.Max)
+}
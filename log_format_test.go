@@ -0,0 +1,124 @@
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that headerless version 0 files are read and stay headerless.
+func TestLogFormatVersion0(t *testing.T) {
+	v0 := `cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n"
+	path := setupLog(v0)
+	defer os.Remove(path)
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	if len(log.entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(log.entries))
+	}
+	log.Append(NewLogEntry(log, 2, 1, &TestCommand2{100}))
+	log.SetCommitIndex(2)
+	log.Close()
+
+	expected := v0 + `4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}` + "\n"
+	if actual, _ := ioutil.ReadFile(path); string(actual) != expected {
+		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+// Ensure that new files get a header and can be read back.
+func TestLogFormatVersion1(t *testing.T) {
+	path := getLogPath()
+	defer os.Remove(path)
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	log.Append(NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}))
+	log.SetCommitIndex(1)
+	log.Close()
+
+	actual, _ := ioutil.ReadFile(path)
+	if !bytes.HasPrefix(actual, []byte("RAFT\x00\x01")) {
+		t.Fatalf("Missing header: %q", actual)
+	}
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	defer log.Close()
+	if len(log.entries) != 1 || log.entries[0].index != 1 {
+		t.Fatalf("Unexpected entries: %v", log.entries)
+	}
+
+	// Entries can also be read from a reader with a header.
+	other := NewLog()
+	other.AddCommandType(&TestCommand1{})
+	if err := other.OpenWriterReader(bytes.NewReader(actual), ioutil.Discard); err != nil {
+		t.Fatalf("Unable to open reader: %v", err)
+	}
+	if len(other.entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(other.entries))
+	}
+}
+
+// Ensure that recovery keeps the header when truncating a corrupt entry.
+func TestLogFormatRecovery(t *testing.T) {
+	path := setupLog(testHeader +
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n" +
+		`6ac5807c 0000000000000003`)
+	defer os.Remove(path)
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	log.Close()
+
+	expected := testHeader + `cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n"
+	if actual, _ := ioutil.ReadFile(path); string(actual) != expected {
+		t.Fatalf("Unexpected buffer:\nexp:\n%q\ngot:\n%q", expected, actual)
+	}
+}
+
+// Ensure that files from a newer format version are rejected.
+func TestLogFormatUnsupportedVersion(t *testing.T) {
+	path := setupLog("RAFT\x00\x02")
+	defer os.Remove(path)
+	log := NewLog()
+	err := log.Open(path)
+	if err != (ErrUnsupportedLogVersion{Got: 2, Max: CurrentFormatVersion}) {
+		t.Fatalf("Expected ErrUnsupportedLogVersion: %v", err)
+	}
+	if log.writer != nil {
+		t.Fatalf("Expected log to be closed")
+	}
+}
+
+// Ensure that a damaged header fails Open instead of truncating the file.
+func TestLogFormatDamagedHeader(t *testing.T) {
+	entry := `cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n"
+	for _, header := range []string{"RAFU\x00\x01", "RAF", "\xd2AFT\x00\x01"} {
+		path := setupLog(header + entry)
+		defer os.Remove(path)
+		log := NewLog()
+		log.AddCommandType(&TestCommand1{})
+		if err := log.Open(path); err == nil {
+			t.Fatalf("Expected error for header %q", header)
+		}
+		if actual, _ := ioutil.ReadFile(path); string(actual) != header+entry {
+			t.Fatalf("Log file should not be modified: %q", actual)
+		}
+	}
+}
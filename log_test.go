@@ -1,10 +1,19 @@
 package raft
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"testing"
+	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
+	"time"
 )
 
 //------------------------------------------------------------------------------
@@ -44,6 +53,9 @@ func (c TestCommand2) Name() string {
 	return "cmd_2"
 }
 
+// The header written to the start of new log files.
+var testHeader = string(encodeHeader(CurrentFormatVersion))
+
 //------------------------------------------------------------------------------
 //
 // Tests
@@ -76,7 +88,7 @@ func TestLogNewLog(t *testing.T) {
 	if err := log.SetCommitIndex(2); err != nil {
 		t.Fatalf("Unable to partially commit: %v", err)
 	}
-	expected := 
+	expected := testHeader +
 		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
 		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n"
 	actual, _ := ioutil.ReadFile(path)
@@ -88,7 +100,7 @@ func TestLogNewLog(t *testing.T) {
 	if err := log.SetCommitIndex(3); err != nil {
 		t.Fatalf("Unable to commit: %v", err)
 	}
-	expected = 
+	expected = testHeader +
 		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
 		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
 		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n"
@@ -183,3 +195,2097 @@ func TestLogRecovery(t *testing.T) {
 		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
 	}
 }
+
+// Ensure that write-ahead entries are only added to the log once committed.
+func TestLogWriteAhead(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	if err := log.WriteAhead(NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20})); err != nil {
+		t.Fatalf("Unable to write ahead: %v", err)
+	}
+	if err := log.WriteAhead(NewLogEntry(log, 2, 1, &TestCommand2{100})); err != nil {
+		t.Fatalf("Unable to write ahead: %v", err)
+	}
+	if err := log.WriteAhead(NewLogEntry(log, 2, 1, &TestCommand2{200})); err == nil {
+		t.Fatalf("Expected error writing ahead a duplicate index")
+	}
+	if len(log.entries) != 0 {
+		t.Fatalf("Expected 0 entries, got %d", len(log.entries))
+	}
+	if actual, _ := ioutil.ReadFile(path); string(actual) != testHeader {
+		t.Fatalf("Unexpected buffer: %s", string(actual))
+	}
+
+	// Partial commit.
+	if err := log.Commit(1); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if len(log.entries) != 1 || len(log.pending) != 1 {
+		t.Fatalf("Expected 1 entry and 1 pending, got %d and %d", len(log.entries), len(log.pending))
+	}
+	expected := testHeader + `cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n"
+	actual, _ := ioutil.ReadFile(path)
+	if string(actual) != expected {
+		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
+	}
+	expected = `4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}` + "\n"
+	actual, _ = ioutil.ReadFile(path + ".wal")
+	if string(actual) != expected {
+		t.Fatalf("Unexpected WAL buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
+	}
+
+	// Full commit removes the WAL.
+	if err := log.Commit(2); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if _, err := os.Stat(path + ".wal"); !os.IsNotExist(err) {
+		t.Fatalf("Expected WAL to be removed: %v", err)
+	}
+}
+
+// Ensure that committed write-ahead entries are appended like any other entry.
+func TestLogWriteAheadCommitAppends(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+
+	var appended []uint64
+	log.OnAppend(func(entry *LogEntry) { appended = append(appended, entry.index) })
+	log.Append(MakeEntry(log, 1, 1, "test", ""))
+	log.WriteAhead(MakeEntry(log, 2, 1, "test", ""))
+	if err := log.Commit(2); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if !reflect.DeepEqual(appended, []uint64{1, 2}) {
+		t.Fatalf("Unexpected appended entries: %v", appended)
+	}
+
+	// An entry appended behind the write-ahead log's back is not duplicated.
+	log.WriteAhead(MakeEntry(log, 3, 1, "test", ""))
+	log.Append(MakeEntry(log, 3, 1, "test", ""))
+	if err := log.Commit(3); err == nil {
+		t.Fatalf("Expected error committing a duplicate index")
+	}
+	if len(log.entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(log.entries))
+	}
+}
+
+// Ensure that write-ahead entries that were not committed survive a crash.
+func TestLogWriteAheadRecovery(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".wal")
+	log.WriteAhead(NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}))
+	log.WriteAhead(NewLogEntry(log, 2, 1, &TestCommand2{100}))
+	log.WriteAhead(NewLogEntry(log, 3, 2, &TestCommand1{"bar", 0}))
+	if err := log.Commit(1); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+
+	// Simulate a crash after the main log was written but before the WAL was
+	// rewritten by putting the committed entry back into the WAL.
+	log.Close()
+	wal, _ := ioutil.ReadFile(path + ".wal")
+	ioutil.WriteFile(path+".wal", append([]byte(`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n"), wal...), 0600)
+
+	log = NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	defer log.Close()
+	if len(log.entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(log.entries))
+	}
+	if len(log.pending) != 2 {
+		t.Fatalf("Expected 2 pending entries, got %d", len(log.pending))
+	}
+	if !reflect.DeepEqual(log.pending[0], NewLogEntry(log, 2, 1, &TestCommand2{100})) {
+		t.Fatalf("Unexpected pending[0]: %v", log.pending[0])
+	}
+
+	if err := log.Commit(3); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	expected := testHeader +
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n"
+	actual, _ := ioutil.ReadFile(path)
+	if string(actual) != expected {
+		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
+	}
+}
+
+// Ensure that parallel recovery decodes entries in order and recovers from an
+// incomplete log the same way as sequential recovery.
+func TestLogParallelRecovery(t *testing.T) {
+	path := setupLog(
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n" +
+		`6ac5807c 0000000000000004 00000000000`)
+	log := NewLog(WithParallelRecovery(4))
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+
+	if len(log.entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(log.entries))
+	}
+	if !reflect.DeepEqual(log.entries[0], NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20})) {
+		t.Fatalf("Unexpected entry[0]: %v", log.entries[0])
+	}
+	if !reflect.DeepEqual(log.entries[1], NewLogEntry(log, 2, 1, &TestCommand2{100})) {
+		t.Fatalf("Unexpected entry[1]: %v", log.entries[1])
+	}
+	if !reflect.DeepEqual(log.entries[2], NewLogEntry(log, 3, 2, &TestCommand1{"bar", 0})) {
+		t.Fatalf("Unexpected entry[2]: %v", log.entries[2])
+	}
+	if log.commitIndex != 3 {
+		t.Fatalf("Unexpected commit index: %d", log.commitIndex)
+	}
+	expected :=
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n"
+	actual, _ := ioutil.ReadFile(path)
+	if string(actual) != expected {
+		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
+	}
+}
+
+// Ensure that only every nth checksum is verified when configured.
+func TestLogChecksumVerifyInterval(t *testing.T) {
+	// The checksum of the second entry is wrong.
+	content :=
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`00000000 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n"
+	tests := []struct {
+		option LogOption
+		count  int
+	}{
+		{WithChecksumVerifyInterval(1), 1},
+		{WithChecksumVerifyInterval(2), 3},
+		{WithChecksumVerifyNone(), 3},
+	}
+	for i, tt := range tests {
+		path := setupLog(content)
+		log := NewLog(tt.option, WithStrictRecovery(true))
+		log.AddCommandType(&TestCommand1{})
+		log.AddCommandType(&TestCommand2{})
+		err := log.Open(path)
+		if tt.count == 1 && err == nil {
+			t.Fatalf("%d. Expected checksum error", i)
+		} else if tt.count == 3 && err != nil {
+			t.Fatalf("%d. Unable to open log: %v", i, err)
+		} else if tt.count == 3 && len(log.entries) != 3 {
+			t.Fatalf("%d. Expected 3 entries, got %d", i, len(log.entries))
+		}
+		log.Close()
+		os.Remove(path)
+	}
+}
+
+// Ensure that a batch of entries can be appended straight from a reader.
+func TestLogAppendBatchFromReader(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+
+	stream := bufio.NewReader(bytes.NewBufferString(
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n"))
+	entries, err := log.AppendBatchFromReader(stream, 2)
+	if err != nil {
+		t.Fatalf("Unable to append: %v", err)
+	}
+	if len(entries) != 2 || len(log.entries) != 2 {
+		t.Fatalf("Unexpected entries: %d, %d", len(entries), len(log.entries))
+	}
+	if !reflect.DeepEqual(log.entries[1], NewLogEntry(log, 2, 1, &TestCommand2{100})) {
+		t.Fatalf("Unexpected entry[1]: %v", log.entries[1])
+	}
+
+	// The remaining entry is still available on the stream.
+	if _, err := log.AppendBatchFromReader(stream, 1); err != nil {
+		t.Fatalf("Unable to append: %v", err)
+	}
+
+	// Out of order and incomplete batches are rejected as a whole.
+	stream = bufio.NewReader(bytes.NewBufferString(
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n"))
+	if _, err := log.AppendBatchFromReader(stream, 1); err == nil {
+		t.Fatalf("Expected error appending an earlier entry")
+	}
+	var buf bytes.Buffer
+	NewLogEntry(log, 4, 2, &TestCommand2{1}).Encode(&buf)
+	if _, err := log.AppendBatchFromReader(&buf, 2); err == nil {
+		t.Fatalf("Expected error appending an incomplete batch")
+	}
+	if len(log.entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(log.entries))
+	}
+}
+
+// Ensure that a follower's divergent suffix is replaced by the leader's entries.
+func TestLogAppendRange(t *testing.T) {
+	leader, follower := NewLog(), NewLog()
+	for _, log := range []*Log{leader, follower} {
+		MustRegisterTestCommand(log, "test")
+		log.OpenWriter(ioutil.Discard)
+	}
+	for i, term := range []uint64{1, 1, 2, 3, 3} {
+		leader.Append(MakeEntry(leader, uint64(i+1), term, "test", "leader"))
+	}
+	for i, term := range []uint64{1, 1, 2, 2, 2, 2} {
+		follower.Append(MakeEntry(follower, uint64(i+1), term, "test", "follower"))
+	}
+	follower.SetCommitIndex(2)
+
+	// Resending the whole log keeps the common prefix and replaces the rest.
+	if err := follower.AppendRange(leader.entries[1:]); err != nil {
+		t.Fatalf("Unable to append range: %v", err)
+	}
+	if len(follower.entries) != len(leader.entries) {
+		t.Fatalf("Expected %d entries, got %d", len(leader.entries), len(follower.entries))
+	}
+	for i, entry := range leader.entries {
+		if follower.entries[i].index != entry.index || follower.entries[i].term != entry.term {
+			t.Fatalf("Mismatched entry[%d]: %v != %v", i, follower.entries[i], entry)
+		}
+	}
+	if follower.entries[2].command.(*TestCommand).Value != "follower" {
+		t.Fatalf("Matching entry should not be replaced: %v", follower.entries[2])
+	}
+	if follower.entries[3].command.(*TestCommand).Value != "leader" {
+		t.Fatalf("Divergent entry should be replaced: %v", follower.entries[3])
+	}
+
+	// Diverging at a committed entry is an error.
+	if err := follower.AppendRange([]*LogEntry{MakeEntry(follower, 2, 2, "test", "x")}); err == nil {
+		t.Fatalf("Expected error truncating a committed entry")
+	}
+	if len(follower.entries) != 5 {
+		t.Fatalf("Expected 5 entries, got %d", len(follower.entries))
+	}
+
+	// Entries that would leave a gap or land before the first entry are errors.
+	if err := follower.AppendRange([]*LogEntry{MakeEntry(follower, 10, 3, "test", "x")}); err == nil {
+		t.Fatalf("Expected error appending past the end of the log")
+	}
+	follower.entries = follower.entries[2:]
+	if err := follower.AppendRange([]*LogEntry{MakeEntry(follower, 1, 3, "test", "x")}); err == nil {
+		t.Fatalf("Expected error appending before the first entry")
+	}
+	if len(follower.entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(follower.entries))
+	}
+}
+
+// Ensure that a snapshot taken during appends is consistent.
+func TestLogSnapshot(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if _, err := log.Snapshot(); err == nil {
+		t.Fatalf("Expected error for closed log")
+	}
+	log.OpenWriter(ioutil.Discard)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := uint64(1); i <= 1000; i++ {
+			log.Append(MakeEntry(log, i, 1, "test", "foo"))
+			if i%10 == 0 {
+				log.SetCommitIndex(i)
+			}
+		}
+	}()
+
+	for done := false; !done; {
+		snapshot, err := log.Snapshot()
+		if err != nil {
+			t.Fatalf("Unable to snapshot: %v", err)
+		}
+		for i, entry := range snapshot.Entries {
+			if entry == nil || entry.index != uint64(i+1) {
+				t.Fatalf("Torn snapshot at %d: %v", i, entry)
+			}
+		}
+		if n := uint64(len(snapshot.Entries)); snapshot.CommitIndex > n {
+			t.Fatalf("Commit index %d beyond last entry %d", snapshot.CommitIndex, n)
+		} else if n > 0 && snapshot.FirstIndex != 1 {
+			t.Fatalf("Unexpected first index: %d", snapshot.FirstIndex)
+		}
+		done = len(snapshot.Entries) == 1000
+	}
+	wg.Wait()
+}
+
+// Ensure that the encoded size of an entry can be calculated without writing it.
+func TestLogEncodedSize(t *testing.T) {
+	log := NewLog()
+	entry := MakeEntry(log, 1, 1, "test", "foo")
+	var buf bytes.Buffer
+	entry.Encode(&buf)
+	if size, err := log.EncodedSize(entry); err != nil || size != buf.Len() {
+		t.Fatalf("Unexpected size: exp %d, got %d (%v)", buf.Len(), size, err)
+	}
+	if _, err := log.EncodedSize(NewLogEntry(log, 1, 1, nil)); err == nil {
+		t.Fatalf("Expected error for missing command")
+	}
+	if _, err := log.EncodedSize(nil); err == nil {
+		t.Fatalf("Expected error for missing entry")
+	}
+}
+
+// Ensure that committed entries can be counted and filtered by a predicate.
+func TestLogCountEntries(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "foo")
+	MustRegisterTestCommand(log, "bar")
+	log.OpenWriter(ioutil.Discard)
+	for i, name := range []string{"foo", "bar", "foo", "foo", "foo"} {
+		log.Append(MakeEntry(log, uint64(i+1), 1, name, ""))
+	}
+	log.SetCommitIndex(4)
+
+	isFoo := func(e *LogEntry) bool { return e.command.Name() == "foo" }
+	if n := log.CountEntries(isFoo); n != 3 {
+		t.Fatalf("Expected 3 committed foo entries, got %d", n)
+	}
+	entries := log.FilterEntries(isFoo)
+	if len(entries) != 3 || entries[0].index != 1 || entries[1].index != 3 || entries[2].index != 4 {
+		t.Fatalf("Unexpected entries: %v", entries)
+	}
+	if entries := log.FilterEntries(func(*LogEntry) bool { return false }); entries != nil {
+		t.Fatalf("Expected no entries: %v", entries)
+	}
+}
+
+// Ensure that the first and last entries can be retrieved.
+func TestLogHeadTail(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	log.OpenWriter(ioutil.Discard)
+	if head, tail := log.Head(1), log.Tail(1); len(head) != 0 || len(tail) != 0 {
+		t.Fatalf("Expected no entries in an empty log: %v, %v", head, tail)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", ""))
+	}
+
+	for _, tt := range []struct {
+		n          int
+		head, tail []uint64
+	}{
+		{0, []uint64{}, []uint64{}},
+		{1, []uint64{1}, []uint64{3}},
+		{3, []uint64{1, 2, 3}, []uint64{1, 2, 3}},
+		{4, []uint64{1, 2, 3}, []uint64{1, 2, 3}},
+	} {
+		for _, x := range []struct {
+			entries []*LogEntry
+			exp     []uint64
+		}{{log.Head(tt.n), tt.head}, {log.Tail(tt.n), tt.tail}} {
+			indices := []uint64{}
+			for _, entry := range x.entries {
+				indices = append(indices, entry.index)
+			}
+			if !reflect.DeepEqual(indices, x.exp) {
+				t.Fatalf("n=%d: Expected %v, got %v", tt.n, x.exp, indices)
+			}
+		}
+	}
+
+	// The returned slice is a copy.
+	log.Head(1)[0] = nil
+	if log.entries[0] == nil {
+		t.Fatalf("Head should return a copy")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected panic for negative count")
+		}
+	}()
+	log.Tail(-1)
+}
+
+// Ensure that committed entries can be iterated in place.
+func TestLogIterateCommitted(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	log.OpenWriter(ioutil.Discard)
+	for i := uint64(1); i <= 5; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", ""))
+	}
+	log.SetCommitIndex(3)
+
+	var entries []*LogEntry
+	if err := log.IterateCommitted(func(e *LogEntry) error {
+		entries = append(entries, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("Unable to iterate: %v", err)
+	}
+	if len(entries) != 3 || entries[0] != log.entries[0] || entries[2] != log.entries[2] {
+		t.Fatalf("Unexpected entries: %v", entries)
+	}
+
+	// Iteration stops at the first error.
+	n, stop := 0, fmt.Errorf("stop")
+	if err := log.IterateCommitted(func(e *LogEntry) error {
+		n++
+		return stop
+	}); err != stop || n != 1 {
+		t.Fatalf("Expected iteration to stop: %v (%d)", err, n)
+	}
+}
+
+// Ensure that a snapshot can be iterated while the log is appended to.
+func TestLogSnapshotIterate(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	log.OpenWriter(ioutil.Discard)
+	for i := uint64(1); i <= 100; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", ""))
+	}
+	log.SetCommitIndex(50)
+	snapshot, _ := log.Snapshot()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			log.AppendNoIndex(1, &TestCommand{})
+		}()
+	}
+
+	var index uint64
+	if err := snapshot.Iterate(func(e *LogEntry) error {
+		if e.index != index+1 {
+			return fmt.Errorf("Unexpected index: %d", e.index)
+		}
+		index = e.index
+		return nil
+	}); err != nil {
+		t.Fatalf("Unable to iterate: %v", err)
+	}
+	wg.Wait()
+	if index != 50 {
+		t.Fatalf("Expected to stop at the commit index: %d", index)
+	}
+	if len(log.entries) != 200 {
+		t.Fatalf("Expected 200 entries, got %d", len(log.entries))
+	}
+}
+
+// Ensure that Drain waits until every entry is committed.
+func TestLogDrain(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	log.OpenWriter(ioutil.Discard)
+	for i := uint64(1); i <= 100; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", ""))
+	}
+
+	go func() {
+		for i := uint64(10); i <= 100; i += 10 {
+			time.Sleep(time.Millisecond)
+			log.SetCommitIndex(i)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := log.Drain(ctx); err != nil {
+		t.Fatalf("Unable to drain: %v", err)
+	}
+	if log.Metadata().CommitIndex != 100 {
+		t.Fatalf("Expected commit index 100, got %d", log.Metadata().CommitIndex)
+	}
+
+	// Drain gives up when the context is done.
+	log.Append(MakeEntry(log, 101, 1, "test", ""))
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := log.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded: %v", err)
+	}
+}
+
+// Ensure that the most recent matching entries can be found from the end.
+func TestLogReverseEntries(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "foo")
+	MustRegisterTestCommand(log, "bar")
+	if err := log.ReverseEntries(func(*LogEntry) bool { return true }); err == nil {
+		t.Fatalf("Expected error for closed log")
+	}
+	log.OpenWriter(ioutil.Discard)
+	for i := uint64(1); i <= 10000; i++ {
+		name := "foo"
+		if i%7 == 0 {
+			name = "bar"
+		}
+		log.Append(MakeEntry(log, i, 1, name, ""))
+	}
+
+	var indices []uint64
+	visited := 0
+	log.ReverseEntries(func(e *LogEntry) bool {
+		visited++
+		if e.command.Name() == "bar" {
+			indices = append(indices, e.index)
+		}
+		return len(indices) < 5
+	})
+	if !reflect.DeepEqual(indices, []uint64{9996, 9989, 9982, 9975, 9968}) {
+		t.Fatalf("Unexpected indices: %v", indices)
+	}
+	if visited != 10000-9968+1 {
+		t.Fatalf("Expected iteration to stop early: %d", visited)
+	}
+}
+
+// Ensure that buffered writes reach the file when entries are committed.
+func TestLogWriteBufferSize(t *testing.T) {
+	path := getLogPath()
+	defer os.Remove(path)
+	log := NewLog(WithWriteBufferSize(4096))
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	buf := bytes.NewBufferString(testHeader)
+	for i := uint64(1); i <= 3; i++ {
+		entry := MakeEntry(log, i, 1, "test", "foo")
+		log.Append(entry)
+		if i <= 2 {
+			entry.Encode(buf)
+		}
+	}
+	if err := log.SetCommitIndex(2); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != buf.String() {
+		t.Fatalf("Unexpected file contents after commit:\n%s", b)
+	}
+
+	if err := log.SetCommitIndex(3); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	log.Close()
+
+	log = NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	defer log.Close()
+	if len(log.entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(log.entries))
+	}
+}
+
+// Ensure that AppendEntries requests are applied as described in Raft §5.3.
+func TestLogAppendEntries(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if _, err := log.AppendEntries(&AppendEntriesRequest{}); err == nil {
+		t.Fatalf("Expected error for closed log")
+	}
+	log.OpenWriter(ioutil.Discard)
+	entry := func(index, term uint64) *LogEntry {
+		return MakeEntry(log, index, term, "test", fmt.Sprintf("%d:%d", term, index))
+	}
+	terms := func() []uint64 {
+		var terms []uint64
+		for _, e := range log.entries {
+			terms = append(terms, e.term)
+		}
+		return terms
+	}
+	appendEntries := func(req *AppendEntriesRequest) bool {
+		resp, err := log.AppendEntries(req)
+		if err != nil {
+			t.Fatalf("Unable to append entries: %v", err)
+		} else if resp.Term != req.Term {
+			t.Fatalf("Unexpected response term: %d", resp.Term)
+		}
+		return resp.Success
+	}
+
+	// An empty log accepts entries with no previous entry.
+	if !appendEntries(&AppendEntriesRequest{Term: 1, Entries: []*LogEntry{entry(1, 1), entry(2, 1), entry(3, 2)}, CommitIndex: 1}) {
+		t.Fatalf("Expected success")
+	}
+	if !reflect.DeepEqual(terms(), []uint64{1, 1, 2}) || log.commitIndex != 1 {
+		t.Fatalf("Unexpected log: %v (commit %d)", terms(), log.commitIndex)
+	}
+
+	// Reject when the log is missing the previous entry.
+	if appendEntries(&AppendEntriesRequest{Term: 2, PrevLogIndex: 5, PrevLogTerm: 2, Entries: []*LogEntry{entry(6, 2)}}) {
+		t.Fatalf("Expected failure for missing previous entry")
+	}
+
+	// Reject when the previous entry's term does not match.
+	if appendEntries(&AppendEntriesRequest{Term: 3, PrevLogIndex: 3, PrevLogTerm: 3, Entries: []*LogEntry{entry(4, 3)}}) {
+		t.Fatalf("Expected failure for mismatched previous term")
+	}
+	if len(log.entries) != 3 {
+		t.Fatalf("Rejected request should not change the log: %v", terms())
+	}
+
+	// Entries already in the log are not appended again.
+	if !appendEntries(&AppendEntriesRequest{Term: 2, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []*LogEntry{entry(2, 1), entry(3, 2)}}) {
+		t.Fatalf("Expected success")
+	}
+	if !reflect.DeepEqual(terms(), []uint64{1, 1, 2}) {
+		t.Fatalf("Unexpected log: %v", terms())
+	}
+
+	// Conflicting entries are replaced along with everything after them, and
+	// the commit index is limited to the last new entry.
+	if !appendEntries(&AppendEntriesRequest{Term: 3, PrevLogIndex: 2, PrevLogTerm: 1, Entries: []*LogEntry{entry(3, 3), entry(4, 3)}, CommitIndex: 10}) {
+		t.Fatalf("Expected success")
+	}
+	if !reflect.DeepEqual(terms(), []uint64{1, 1, 3, 3}) || log.commitIndex != 4 {
+		t.Fatalf("Unexpected log: %v (commit %d)", terms(), log.commitIndex)
+	}
+
+	// A heartbeat advances the commit index no further than the previous entry.
+	log.Append(entry(5, 3))
+	if !appendEntries(&AppendEntriesRequest{Term: 3, PrevLogIndex: 4, PrevLogTerm: 3, CommitIndex: 5}) {
+		t.Fatalf("Expected success")
+	}
+	if log.commitIndex != 4 {
+		t.Fatalf("Unexpected commit index: %d", log.commitIndex)
+	}
+
+	// Conflicts with committed entries and non-contiguous entries are errors.
+	if _, err := log.AppendEntries(&AppendEntriesRequest{Term: 4, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []*LogEntry{entry(2, 4)}}); err == nil {
+		t.Fatalf("Expected error replacing a committed entry")
+	}
+	if _, err := log.AppendEntries(&AppendEntriesRequest{Term: 4, PrevLogIndex: 1, PrevLogTerm: 1, Entries: []*LogEntry{entry(3, 4)}}); err == nil {
+		t.Fatalf("Expected error for entries that do not follow the previous entry")
+	}
+}
+
+// Ensure that a compacted follower still matches entries in its snapshot.
+func TestLogAppendEntriesCompacted(t *testing.T) {
+	path := getLogPath()
+	defer os.Remove(path)
+	defer os.Remove(path + ".snap")
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	for i := uint64(1); i <= 5; i++ {
+		log.Append(MakeEntry(log, i, 2, "test", ""))
+	}
+	log.SetCommitIndex(5)
+	if err := log.Compact(5, []byte("state@5")); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	entry := func(index uint64) *LogEntry { return MakeEntry(log, index, 2, "test", "") }
+
+	// The previous entry at the snapshot index is checked against its term.
+	if resp, err := log.AppendEntries(&AppendEntriesRequest{Term: 2, PrevLogIndex: 5, PrevLogTerm: 1, Entries: []*LogEntry{entry(6)}}); err != nil || resp.Success {
+		t.Fatalf("Expected failure for mismatched snapshot term: %v (%v)", resp, err)
+	}
+	if resp, err := log.AppendEntries(&AppendEntriesRequest{Term: 2, PrevLogIndex: 5, PrevLogTerm: 2, Entries: []*LogEntry{entry(6)}}); err != nil || !resp.Success {
+		t.Fatalf("Expected success: %v (%v)", resp, err)
+	}
+
+	// Entries covered by the snapshot are dropped rather than appended.
+	if resp, err := log.AppendEntries(&AppendEntriesRequest{Term: 2, Entries: []*LogEntry{entry(1), entry(2), entry(3), entry(4), entry(5), entry(6), entry(7)}}); err != nil || !resp.Success {
+		t.Fatalf("Expected success: %v (%v)", resp, err)
+	}
+	if len(log.entries) != 2 || log.entries[0].index != 6 || log.entries[1].index != 7 {
+		t.Fatalf("Unexpected entries: %v", log.entries)
+	}
+
+	// The snapshot term survives a reopen.
+	log.Close()
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	if log.compactIndex != 5 || log.compactTerm != 2 {
+		t.Fatalf("Unexpected snapshot: %d:%d", log.compactTerm, log.compactIndex)
+	}
+}
+
+// Ensure that the Replay snapshot index does not change replication.
+func TestLogAppendEntriesSnapshotIndex(t *testing.T) {
+	log := NewLog(WithSnapshotIndex(3))
+	MustRegisterTestCommand(log, "test")
+	log.OpenWriter(ioutil.Discard)
+	defer log.Close()
+	var entries []*LogEntry
+	for i := uint64(1); i <= 5; i++ {
+		entries = append(entries, MakeEntry(log, i, 1, "test", ""))
+	}
+
+	if resp, err := log.AppendEntries(&AppendEntriesRequest{Term: 1, Entries: entries}); err != nil || !resp.Success {
+		t.Fatalf("Expected success: %v (%v)", resp, err)
+	}
+	if len(log.entries) != 5 {
+		t.Fatalf("Expected 5 entries, got %d", len(log.entries))
+	}
+	if resp, err := log.AppendEntries(&AppendEntriesRequest{Term: 2, PrevLogIndex: 3, PrevLogTerm: 2}); err != nil || resp.Success {
+		t.Fatalf("Expected failure for mismatched previous term: %v (%v)", resp, err)
+	}
+
+	b, err := json.Marshal(log)
+	if err != nil {
+		t.Fatalf("Unable to marshal: %v", err)
+	} else if err := json.Unmarshal(b, NewLog()); err != nil {
+		t.Fatalf("Unable to unmarshal %s: %v", b, err)
+	}
+}
+
+// Ensure that compaction saves a snapshot and removes the entries it covers.
+func TestLogCompact(t *testing.T) {
+	path := getLogPath()
+	defer os.Remove(path)
+	defer os.Remove(path + ".snap")
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	for i := uint64(1); i <= 5; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", ""))
+	}
+	log.SetCommitIndex(4)
+
+	if err := log.Compact(5, []byte("state")); err == nil {
+		t.Fatalf("Expected error compacting an uncommitted entry")
+	}
+	if err := log.Compact(2, []byte("state@2")); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	if err := log.Compact(3, []byte("state@3")); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+	if len(log.entries) != 2 || log.entries[0].index != 4 || log.Metadata().SnapshotLastIndex != 3 {
+		t.Fatalf("Unexpected entries: %v", log.entries)
+	}
+	if index, data, err := log.LoadSnapshot(); err != nil || index != 3 || string(data) != "state@3" {
+		t.Fatalf("Unexpected snapshot: %d, %q (%v)", index, data, err)
+	}
+
+	// The log keeps appending to the rewritten file.
+	log.SetCommitIndex(5)
+	log.Close()
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	defer log.Close()
+	if len(log.entries) != 2 || log.entries[0].index != 4 || log.entries[1].index != 5 {
+		t.Fatalf("Unexpected entries after reopen: %v", log.entries)
+	}
+}
+
+// Ensure that Open finishes a compaction interrupted after the snapshot was saved.
+func TestLogCompactRecovery(t *testing.T) {
+	path := getLogPath()
+	defer os.Remove(path)
+	defer os.Remove(path + ".snap")
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", ""))
+	}
+	log.SetCommitIndex(3)
+
+	// Simulate a crash after the snapshot is renamed into place.
+	if err := log.writeSnapshot(2, 1, []byte("state@2")); err != nil {
+		t.Fatalf("Unable to write snapshot: %v", err)
+	}
+	log.Close()
+
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	if len(log.entries) != 1 || log.entries[0].index != 3 {
+		t.Fatalf("Unexpected entries: %v", log.entries)
+	}
+	log.Close()
+	var buf bytes.Buffer
+	MakeEntry(log, 3, 1, "test", "").Encode(&buf)
+	if actual, _ := ioutil.ReadFile(path); string(actual) != testHeader+buf.String() {
+		t.Fatalf("Unexpected buffer: %q", actual)
+	}
+
+	// A fully compacted log continues from the snapshot index.
+	log.Open(path)
+	log.Compact(3, []byte("state@3"))
+	log.Close()
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	defer log.Close()
+	if len(log.entries) != 0 || log.commitIndex != 3 {
+		t.Fatalf("Unexpected log: %v (commit %d)", log.entries, log.commitIndex)
+	}
+
+	// New entries continue after the snapshot rather than reusing its indices.
+	if err := log.Append(MakeEntry(log, 2, 1, "test", "")); err == nil {
+		t.Fatalf("Expected error appending an entry in the snapshot")
+	}
+	if err := log.WriteAhead(MakeEntry(log, 3, 1, "test", "")); err == nil {
+		t.Fatalf("Expected error writing ahead an entry in the snapshot")
+	}
+	if index, err := log.AppendNoIndex(1, &TestCommand{}); err != nil || index != 4 {
+		t.Fatalf("Unexpected index: %d (%v)", index, err)
+	}
+	log.SetCommitIndex(4)
+	log.Close()
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	if len(log.entries) != 1 || log.entries[0].index != 4 {
+		t.Fatalf("Unexpected entries after reopen: %v", log.entries)
+	}
+}
+
+// Ensure that disk usage covers the log, snapshot and archived files.
+func TestLogDiskUsageStats(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if _, err := log.DiskUsageStats(); err == nil {
+		t.Fatalf("Expected error for unknown path")
+	}
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer func() {
+		matches, _ := filepath.Glob(path + "*")
+		for _, match := range matches {
+			os.Remove(match)
+		}
+	}()
+
+	for i := uint64(1); i <= 10; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", "foo"))
+	}
+	log.SetCommitIndex(5)
+	if err := log.Rotate(); err != nil {
+		t.Fatalf("Unable to rotate: %v", err)
+	}
+	log.SetCommitIndex(10)
+	log.Compact(4, []byte("state@4"))
+	log.Compact(8, []byte("state@8"))
+
+	sizeOf := func(path string) int64 {
+		stat, _ := os.Stat(path)
+		return stat.Size()
+	}
+	archives, _ := filepath.Glob(path + ".*.log")
+	if len(archives) != 1 {
+		t.Fatalf("Expected 1 archive, got %v", archives)
+	}
+	expected := DiskUsage{
+		LogBytes:      sizeOf(path),
+		SnapshotBytes: int64(len("0000000000000008 0000000000000001\nstate@8")),
+		ArchiveBytes:  sizeOf(archives[0]),
+	}
+	expected.Total = expected.LogBytes + expected.SnapshotBytes + expected.ArchiveBytes
+	usage, err := log.DiskUsageStats()
+	if err != nil {
+		t.Fatalf("Unable to get disk usage: %v", err)
+	} else if usage != expected {
+		t.Fatalf("Unexpected disk usage: exp %+v, got %+v", expected, usage)
+	}
+	if total, _ := log.EstimatedDiskUsage(); total != expected.Total {
+		t.Fatalf("Unexpected total: %d", total)
+	}
+}
+
+// Ensure that duplicated entries are removed from memory and from the file.
+func TestLogDeduplicateEntries(t *testing.T) {
+	path := setupLog(
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n")
+	defer os.Remove(path)
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+
+	report, err := log.DeduplicateEntries()
+	if err != nil {
+		t.Fatalf("Unable to deduplicate: %v", err)
+	} else if report.DuplicatesRemoved != 1 {
+		t.Fatalf("Expected 1 duplicate removed, got %d", report.DuplicatesRemoved)
+	}
+	if len(log.entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(log.entries))
+	}
+	expected := testHeader +
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n"
+	if actual, _ := ioutil.ReadFile(path); string(actual) != expected {
+		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, actual)
+	}
+
+	// A clean log is left alone.
+	if report, err := log.DeduplicateEntries(); err != nil || report.DuplicatesRemoved != 0 {
+		t.Fatalf("Unexpected report: %v (%v)", report, err)
+	}
+}
+
+// Ensure that the entries of each term can be found.
+func TestLogPrefixScan(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if _, err := log.PrefixScan(1); err == nil {
+		t.Fatalf("Expected error for closed log")
+	}
+	log.OpenWriter(ioutil.Discard)
+	for i, term := range []uint64{1, 1, 2, 4, 4, 4, 5, 7} {
+		log.Append(MakeEntry(log, uint64(i+1), term, "test", ""))
+	}
+
+	for term, exp := range map[uint64][]uint64{
+		0: {},
+		1: {1, 2},
+		2: {3},
+		3: {},
+		4: {4, 5, 6},
+		5: {7},
+		7: {8},
+		8: {},
+	} {
+		entries, err := log.PrefixScan(term)
+		if err != nil {
+			t.Fatalf("Unable to scan term %d: %v", term, err)
+		}
+		indices := []uint64{}
+		for _, entry := range entries {
+			indices = append(indices, entry.index)
+		}
+		if !reflect.DeepEqual(indices, exp) {
+			t.Fatalf("Term %d: expected %v, got %v", term, exp, indices)
+		}
+	}
+}
+
+// Ensure that synced entries can be read back without closing the log.
+func TestLogSync(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Sync(); err == nil {
+		t.Fatalf("Expected error for closed log")
+	}
+	log.OpenWriter(ioutil.Discard)
+	if err := log.Sync(); err == nil {
+		t.Fatalf("Expected error for writer-backed log")
+	}
+	log.Close()
+
+	path := getLogPath()
+	defer os.Remove(path)
+	log = NewLog(WithWriteBufferSize(65536))
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	for i := uint64(1); i <= 1000; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", "foo"))
+	}
+	log.SetCommitIndex(1000)
+	if err := log.Sync(); err != nil {
+		t.Fatalf("Unable to sync: %v", err)
+	}
+
+	// Read the file as a restarted process would, without closing the log.
+	other := NewLog()
+	MustRegisterTestCommand(other, "test")
+	if err := other.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer other.Close()
+	if len(other.entries) != 1000 {
+		t.Fatalf("Expected 1000 entries, got %d", len(other.entries))
+	}
+	log.Close()
+}
+
+// Ensure that the callback receives exactly the newly committed entries.
+func TestLogSetCommitIndexWithCallback(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	log.OpenWriter(ioutil.Discard)
+	for i := uint64(1); i <= 10; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", ""))
+	}
+	log.SetCommitIndex(3)
+
+	var indices []uint64
+	if err := log.SetCommitIndexWithCallback(7, func(entries []*LogEntry) {
+		for _, entry := range entries {
+			indices = append(indices, entry.index)
+		}
+	}); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if !reflect.DeepEqual(indices, []uint64{4, 5, 6, 7}) {
+		t.Fatalf("Unexpected entries: %v", indices)
+	}
+
+	// Nothing newly committed means no callback.
+	called := false
+	log.SetCommitIndexWithCallback(7, func([]*LogEntry) { called = true })
+	if called {
+		t.Fatalf("Callback should not be called when nothing is committed")
+	}
+}
+
+// Ensure that an ephemeral log commits entries without writing them.
+func TestLogOpenEphemeral(t *testing.T) {
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	if err := log.OpenEphemeral(); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	} else if !log.EphemeralMode() {
+		t.Fatalf("Expected ephemeral mode")
+	}
+
+	committed := 0
+	log.OnCommit(func(*LogEntry) { committed++ })
+	for i := 1; i <= 100000; i++ {
+		if err := log.Append(NewLogEntry(log, uint64(i), 1, &TestCommand1{"foo", i})); err != nil {
+			t.Fatalf("Unable to append: %v", err)
+		}
+	}
+	if err := log.SetCommitIndex(100000); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if committed != 100000 || log.GetEntry(100000) == nil {
+		t.Fatalf("Expected 100000 committed entries, got %d", committed)
+	}
+	if err := log.WriteAhead(NewLogEntry(log, 100001, 1, &TestCommand1{})); err == nil {
+		t.Fatalf("Expected error writing ahead without a file")
+	}
+	if err := log.Sync(); err != nil {
+		t.Fatalf("Unable to sync: %v", err)
+	}
+	if err := log.OpenEphemeral(); err == nil {
+		t.Fatalf("Expected error opening an open log")
+	}
+
+	log.Close()
+	if log.EphemeralMode() || len(log.entries) != 0 {
+		t.Fatalf("Expected closed log to be cleared")
+	}
+
+	// Per-term files are ignored in memory.
+	log = NewLog(WithPerTermFiles(true))
+	log.AddCommandType(&TestCommand1{})
+	log.OpenEphemeral()
+	defer log.Close()
+	log.Append(NewLogEntry(log, 1, 1, &TestCommand1{"foo", 1}))
+	log.Append(NewLogEntry(log, 2, 2, &TestCommand1{"bar", 2}))
+	if err := log.SetCommitIndex(2); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+}
+
+// Ensure that waiters are notified when their entry is committed or replaced.
+func TestLogWaitForCommit(t *testing.T) {
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	ctx := context.Background()
+	if err := log.WaitForCommit(ctx, 1); err == nil {
+		t.Fatalf("Expected error for closed log")
+	}
+	log.OpenWriter(ioutil.Discard)
+	for i := uint64(1); i <= 5; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", ""))
+	}
+	log.SetCommitIndex(1)
+	if err := log.WaitForCommit(ctx, 1); err != nil {
+		t.Fatalf("Expected committed entry to return immediately: %v", err)
+	}
+
+	// Wait on several entries and commit some of them.
+	errs := make(chan error, 3)
+	for _, index := range []uint64{2, 3, 3} {
+		go func(index uint64) { errs <- log.WaitForCommit(ctx, index) }(index)
+	}
+	replaced := make(chan error, 1)
+	go func() { replaced <- log.WaitForCommit(ctx, 5) }()
+	for {
+		log.mutex.Lock()
+		n := len(log.commitWaiters[2]) + len(log.commitWaiters[3]) + len(log.commitWaiters[5])
+		log.mutex.Unlock()
+		if n == 4 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	log.SetCommitIndex(3)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// A waiter on a replaced entry gets an error.
+	if err := log.AppendRange([]*LogEntry{MakeEntry(log, 5, 2, "test", "")}); err != nil {
+		t.Fatalf("Unable to append range: %v", err)
+	}
+	if err := <-replaced; err == nil {
+		t.Fatalf("Expected error for replaced entry")
+	}
+
+	// A waiter gives up when its context is done.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := log.WaitForCommit(ctx, 4); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded: %v", err)
+	}
+	if len(log.commitWaiters) != 0 {
+		t.Fatalf("Expected waiters to be removed: %v", log.commitWaiters)
+	}
+}
+
+// Ensure that command types can be reset and registered again.
+func TestLogResetCommandTypes(t *testing.T) {
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+
+	log.OpenWriter(ioutil.Discard)
+	if err := log.ResetCommandTypes(); err == nil {
+		t.Fatalf("Expected error while log is open")
+	}
+	log.Close()
+
+	if err := log.ResetCommandTypes(); err != nil {
+		t.Fatalf("Unable to reset command types: %v", err)
+	}
+	if _, err := log.NewCommand("cmd_1"); err == nil {
+		t.Fatalf("Expected error for unregistered command")
+	}
+	if err := log.ReplaceCommandType(&TestCommand1{}); err == nil {
+		t.Fatalf("Expected error replacing unregistered command")
+	}
+	if err := log.ReplaceCommandType(nil); err == nil {
+		t.Fatalf("Expected error replacing nil command")
+	}
+
+	log.AddCommandType(&TestCommand1{})
+	if err := log.ReplaceCommandType(&TestCommand1{}); err != nil {
+		t.Fatalf("Unable to replace command type: %v", err)
+	}
+	command, err := log.NewCommand("cmd_1")
+	if err != nil {
+		t.Fatalf("Unable to create command: %v", err)
+	}
+	if _, ok := command.(*TestCommand1); !ok {
+		t.Fatalf("Unexpected command type: %T", command)
+	}
+}
+
+// Ensure that command types can be replaced while entries are being decoded.
+// Run with -race.
+func TestLogReplaceCommandTypeConcurrent(t *testing.T) {
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.OpenWriter(ioutil.Discard)
+	defer log.Close()
+
+	var buf bytes.Buffer
+	for i := uint64(1); i <= 200; i++ {
+		NewLogEntry(log, i, 1, &TestCommand1{"foo", int(i)}).Encode(&buf)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := log.AppendBatchFromReader(bufio.NewReader(&buf), 200)
+		done <- err
+	}()
+	for i := 0; i < 100; i++ {
+		if err := log.ReplaceCommandType(&TestCommand1{}); err != nil {
+			t.Fatalf("Unable to replace command type: %v", err)
+		}
+		CheckAllRegistered(log)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Unable to append: %v", err)
+	}
+	if len(log.entries) != 200 {
+		t.Fatalf("Expected 200 entries, got %d", len(log.entries))
+	}
+}
+
+// Ensure that invalid entries are never written and fail Open instead of being
+// truncated away.
+func TestLogInvalidEntryReopen(t *testing.T) {
+	path := getLogPath()
+	defer os.Remove(path)
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	if err := log.Append(MakeEntry(log, 1, 0, "test", "foo")); err == nil {
+		t.Fatalf("Expected error appending entry with zero term")
+	}
+	log.Close()
+
+	// Write entries with a zero term by skipping validation.
+	log = NewLog(WithSkipValidation(true))
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	log.Append(MakeEntry(log, 1, 0, "test", "foo"))
+	log.Append(MakeEntry(log, 2, 0, "test", "bar"))
+	if err := log.SetCommitIndex(2); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	log.Close()
+	before, _ := ioutil.ReadFile(path)
+
+	log = NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err == nil {
+		t.Fatalf("Expected error opening log with invalid entries")
+	} else if _, ok := err.(ErrInvalidEntry); !ok {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if after, _ := ioutil.ReadFile(path); !bytes.Equal(before, after) {
+		t.Fatalf("Log file should not be modified:\n%q\n%q", before, after)
+	}
+}
+
+//------------------------------------------------------------------------------
+//
+// Benchmarks
+//
+//------------------------------------------------------------------------------
+
+// Writes a log file containing n entries and returns its path.
+func setupBenchmarkLog(b *testing.B, n int) string {
+	f, _ := ioutil.TempFile("", "raft-log-")
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	log := NewLog()
+	for i := 1; i <= n; i++ {
+		if err := NewLogEntry(log, uint64(i), uint64(i/1000)+1, &TestCommand1{"foo", i}).Encode(w); err != nil {
+			b.Fatalf("Unable to encode: %v", err)
+		}
+	}
+	w.Flush()
+	return f.Name()
+}
+
+func BenchmarkLogOpenChecksum(b *testing.B) {
+	path := setupBenchmarkLog(b, 100000)
+	defer os.Remove(path)
+
+	for _, n := range []int{1, 10, 0} {
+		b.Run(fmt.Sprintf("interval=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				log := NewLog(WithChecksumVerifyInterval(n))
+				log.AddCommandType(&TestCommand1{})
+				if err := log.Open(path); err != nil {
+					b.Fatalf("Unable to open log: %v", err)
+				}
+				log.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkLogOpen(b *testing.B) {
+	path := setupBenchmarkLog(b, 100000)
+	defer os.Remove(path)
+
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				log := NewLog(WithParallelRecovery(workers))
+				log.AddCommandType(&TestCommand1{})
+				if err := log.Open(path); err != nil {
+					b.Fatalf("Unable to open log: %v", err)
+				}
+				log.Close()
+			}
+		})
+	}
+}
+
+// Ensure that per-term files cannot be used without a log file.
+func TestLogPerTermFilesWriter(t *testing.T) {
+	log := NewLog(WithPerTermFiles(true))
+	if err := log.OpenWriter(ioutil.Discard); err == nil {
+		t.Fatalf("Expected error opening a writer with per-term files")
+	}
+}
+
+// Ensure that each term is written to its own file and read back in order.
+func TestLogPerTermFiles(t *testing.T) {
+	path := getLogPath()
+	log := NewLog(WithPerTermFiles(true))
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer os.Remove(log.termPath(1))
+	defer os.Remove(log.termPath(2))
+	defer os.Remove(log.termPath(3))
+
+	log.Append(NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}))
+	log.Append(NewLogEntry(log, 2, 1, &TestCommand2{100}))
+	log.Append(NewLogEntry(log, 3, 2, &TestCommand1{"bar", 0}))
+	log.Append(NewLogEntry(log, 4, 3, &TestCommand2{200}))
+	if err := log.SetCommitIndex(4); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	log.Close()
+
+	// Validate the files for each term.
+	if _, err := os.Stat(log.termPath(0)); !os.IsNotExist(err) {
+		t.Fatalf("Expected empty initial term file to be removed: %v", err)
+	}
+	expected := map[uint64]string{
+		1: testHeader + `cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n" +
+			`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}` + "\n",
+		2: testHeader + `6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}` + "\n",
+	}
+	for term, exp := range expected {
+		actual, _ := ioutil.ReadFile(log.termPath(term))
+		if string(actual) != exp {
+			t.Fatalf("Unexpected buffer for term %d:\nexp:\n%s\ngot:\n%s", term, exp, string(actual))
+		}
+	}
+	if terms, _ := log.terms(); !reflect.DeepEqual(terms, []uint64{1, 2, 3}) {
+		t.Fatalf("Unexpected terms: %v", terms)
+	}
+
+	// Reopen and stitch the files back together.
+	log = NewLog(WithPerTermFiles(true))
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	defer log.Close()
+	if len(log.entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(log.entries))
+	}
+	if !reflect.DeepEqual(log.entries[2], NewLogEntry(log, 3, 2, &TestCommand1{"bar", 0})) {
+		t.Fatalf("Unexpected entry[2]: %v", log.entries[2])
+	}
+	if !reflect.DeepEqual(log.entries[3], NewLogEntry(log, 4, 3, &TestCommand2{200})) {
+		t.Fatalf("Unexpected entry[3]: %v", log.entries[3])
+	}
+	if log.commitIndex != 4 || log.fileTerm != 3 {
+		t.Fatalf("Unexpected commit index or term: %d, %d", log.commitIndex, log.fileTerm)
+	}
+}
+
+// Ensure that repair backs up the log and truncates it at the first corrupt entry.
+func TestLogRepair(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer os.Remove(path)
+	defer os.Remove(path + ".bak")
+	for i := 1; i <= 1000; i++ {
+		log.Append(MakeEntry(log, uint64(i), 1, "test", "foo"))
+	}
+	if err := log.SetCommitIndex(1000); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	log.Close()
+
+	// Corrupt the checksum of the 501st entry.
+	original, _ := ioutil.ReadFile(path)
+	lines := bytes.SplitAfter(original, []byte("\n"))
+	offset := 0
+	for _, line := range lines[:500] {
+		offset += len(line)
+	}
+	corrupt := append([]byte{}, original...)
+	corrupt[offset] = 'x'
+	ioutil.WriteFile(path, corrupt, 0600)
+
+	if _, err := NewLog().Repair(); err == nil {
+		t.Fatalf("Expected error repairing a log without a path")
+	}
+	report, err := log.Repair()
+	if err != nil {
+		t.Fatalf("Unable to repair: %v", err)
+	}
+	if *report != (RepairReport{GoodEntries: 500, TruncatedAtIndex: 501, BackupPath: path + ".bak"}) {
+		t.Fatalf("Unexpected report: %v", report)
+	}
+	if backup, _ := ioutil.ReadFile(path + ".bak"); !bytes.Equal(backup, corrupt) {
+		t.Fatalf("Unexpected backup contents")
+	}
+	if actual, _ := ioutil.ReadFile(path); !bytes.Equal(actual, original[:offset]) {
+		t.Fatalf("Unexpected repaired contents")
+	}
+
+	// A repaired log does not need any further repair.
+	if report, err = log.Repair(); err != nil || *report != (RepairReport{GoodEntries: 500}) {
+		t.Fatalf("Unexpected second repair: %v (%v)", report, err)
+	}
+}
+
+// Ensure that strict recovery fails on an incomplete log instead of truncating it.
+func TestLogStrictRecovery(t *testing.T) {
+	content :=
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 00000000000`
+	path := setupLog(content)
+	defer os.Remove(path)
+	defer os.Remove(path + ".bak")
+	log := NewLog(WithStrictRecovery(true))
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+
+	err := log.Open(path)
+	if err != (ErrPartialEntry{AtOffset: 129}) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(log.entries) != 0 || log.file != nil {
+		t.Fatalf("Expected log to be left closed")
+	}
+	if actual, _ := ioutil.ReadFile(path); string(actual) != content {
+		t.Fatalf("Unexpected buffer:\n%s", string(actual))
+	}
+
+	// Repair explicitly and reopen.
+	if _, err := log.Repair(); err != nil {
+		t.Fatalf("Unable to repair: %v", err)
+	}
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	if len(log.entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(log.entries))
+	}
+}
+
+// Ensure that rotating archives the log file and keeps all entries available.
+func TestLogRotate(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+	for i := 1; i <= 10000; i++ {
+		log.Append(MakeEntry(log, uint64(i), 1, "test", "foo"))
+	}
+	if err := log.SetCommitIndex(10000); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	original, _ := ioutil.ReadFile(path)
+
+	if err := log.Rotate(); err != nil {
+		t.Fatalf("Unable to rotate: %v", err)
+	}
+	archives, _ := filepath.Glob(path + ".*.log")
+	if len(archives) != 1 {
+		t.Fatalf("Expected 1 archive, got %v", archives)
+	}
+	defer os.Remove(archives[0])
+	if actual, _ := ioutil.ReadFile(archives[0]); !bytes.Equal(actual, original) {
+		t.Fatalf("Unexpected archive contents")
+	}
+
+	for i := 10001; i <= 10100; i++ {
+		log.Append(MakeEntry(log, uint64(i), 2, "test", "bar"))
+	}
+	if err := log.SetCommitIndex(10100); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if actual, _ := ioutil.ReadFile(path); bytes.Count(actual, []byte("\n")) != 100 {
+		t.Fatalf("Expected 100 entries in the new file")
+	}
+
+	// Validate entries from both files.
+	for _, index := range []uint64{1, 5000, 10000, 10001, 10100} {
+		if entry := log.GetEntry(index); entry == nil || entry.index != index {
+			t.Fatalf("Unexpected entry at %d: %v", index, entry)
+		}
+	}
+	if entry := log.GetEntry(10101); entry != nil {
+		t.Fatalf("Unexpected entry at 10101: %v", entry)
+	}
+}
+
+// Ensure that a log can be written to and read from arbitrary streams.
+func TestLogOpenWriter(t *testing.T) {
+	pr, pw := io.Pipe()
+	done := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(pr)
+		done <- b
+	}()
+
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.OpenWriter(pw); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	log.Append(NewLogEntry(log, 1, 1, &TestCommand1{"foo", 20}))
+	log.Append(NewLogEntry(log, 2, 1, &TestCommand2{100}))
+	log.Append(NewLogEntry(log, 3, 2, &TestCommand1{"bar", 0}))
+	if err := log.SetCommitIndex(3); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if err := log.WriteAhead(NewLogEntry(log, 4, 2, &TestCommand2{1})); err == nil {
+		t.Fatalf("Expected write-ahead error without a log file")
+	}
+	log.Close()
+	pw.Close()
+
+	expected :=
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n"
+	actual := <-done
+	if string(actual) != expected {
+		t.Fatalf("Unexpected buffer:\nexp:\n%s\ngot:\n%s", expected, string(actual))
+	}
+
+	// Read the encoded entries back.
+	if err := log.OpenWriterReader(bytes.NewReader(actual), ioutil.Discard); err != nil {
+		t.Fatalf("Unable to reopen log: %v", err)
+	}
+	if len(log.entries) != 3 || log.commitIndex != 3 {
+		t.Fatalf("Unexpected entries: %d (%d)", len(log.entries), log.commitIndex)
+	}
+	if !reflect.DeepEqual(log.entries[1], NewLogEntry(log, 2, 1, &TestCommand2{100})) {
+		t.Fatalf("Unexpected entry[1]: %v", log.entries[1])
+	}
+	log.Close()
+
+	// A corrupt reader cannot be recovered.
+	if err := log.OpenWriterReader(bytes.NewReader(actual[:len(actual)-5]), ioutil.Discard); err != (ErrPartialEntry{AtOffset: 129}) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// Ensure that log metadata can be round-tripped through JSON.
+func TestLogMarshalJSON(t *testing.T) {
+	path := setupLog(
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n")
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+	log.Append(NewLogEntry(log, 3, 2, &TestCommand1{"bar", 0}))
+
+	b, err := json.Marshal(log)
+	if err != nil {
+		t.Fatalf("Unable to marshal: %v", err)
+	}
+	if string(b) != `{"firstIndex":1,"lastIndex":3,"commitIndex":2,"entryCount":3,"snapshotLastIndex":0}` {
+		t.Fatalf("Unexpected JSON: %s", b)
+	}
+	if err := json.Unmarshal(b, log); err == nil {
+		t.Fatalf("Expected error unmarshaling into an open log")
+	}
+
+	other := NewLog()
+	if err := json.Unmarshal(b, other); err != nil {
+		t.Fatalf("Unable to unmarshal: %v", err)
+	}
+	if m := other.Metadata(); m != (LogMetadata{FirstIndex: 1, LastIndex: 3, CommitIndex: 2, EntryCount: 3}) {
+		t.Fatalf("Unexpected metadata: %v", m)
+	}
+	if b2, _ := json.Marshal(other); string(b2) != string(b) {
+		t.Fatalf("Unexpected round-trip JSON: %s", b2)
+	}
+
+	// Reject inconsistent metadata.
+	for _, s := range []string{
+		`{"firstIndex":3,"lastIndex":1,"commitIndex":0,"entryCount":2}`,
+		`{"firstIndex":1,"lastIndex":3,"commitIndex":4,"entryCount":3}`,
+		`{"firstIndex":1,"lastIndex":3,"commitIndex":0,"entryCount":4}`,
+		`{"firstIndex":1,"lastIndex":3,"commitIndex":0,"entryCount":0}`,
+	} {
+		if err := json.Unmarshal([]byte(s), NewLog()); err == nil {
+			t.Fatalf("Expected error unmarshaling: %s", s)
+		}
+	}
+}
+
+// Ensure that the metadata of a compacted log can be round-tripped through JSON.
+func TestLogMarshalJSONCompacted(t *testing.T) {
+	path := getLogPath()
+	defer os.Remove(path)
+	defer os.Remove(path + ".snap")
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	for i := uint64(1); i <= 5; i++ {
+		log.Append(MakeEntry(log, i, 1, "test", ""))
+	}
+	log.SetCommitIndex(5)
+	if err := log.Compact(5, []byte("state@5")); err != nil {
+		t.Fatalf("Unable to compact: %v", err)
+	}
+
+	b, err := json.Marshal(log)
+	if err != nil {
+		t.Fatalf("Unable to marshal: %v", err)
+	}
+	if string(b) != `{"firstIndex":0,"lastIndex":0,"commitIndex":5,"entryCount":0,"snapshotLastIndex":5}` {
+		t.Fatalf("Unexpected JSON: %s", b)
+	}
+	other := NewLog()
+	if err := json.Unmarshal(b, other); err != nil {
+		t.Fatalf("Unable to unmarshal: %v", err)
+	}
+	if m := other.Metadata(); m != log.Metadata() {
+		t.Fatalf("Unexpected metadata: %v", m)
+	}
+}
+
+// Ensure that append callbacks receive every entry appended concurrently.
+func TestLogOnAppend(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+
+	var received [][]uint64
+	for i := 0; i < 2; i++ {
+		i := i
+		received = append(received, nil)
+		log.OnAppend(func(entry *LogEntry) {
+			received[i] = append(received[i], entry.index)
+		})
+	}
+
+	// Append from multiple goroutines.
+	var mutex sync.Mutex
+	var index uint64
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				mutex.Lock()
+				index++
+				if err := log.Append(MakeEntry(log, index, 1, "test", "foo")); err != nil {
+					t.Errorf("Unable to append: %v", err)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range received {
+		if len(received[i]) != 1000 {
+			t.Fatalf("Callback %d: Expected 1000 entries, got %d", i, len(received[i]))
+		}
+		for j, index := range received[i] {
+			if index != uint64(j+1) {
+				t.Fatalf("Callback %d: Unexpected index at %d: %d", i, j, index)
+			}
+		}
+	}
+}
+
+// Ensure that a slow append callback does not block appending.
+func TestLogOnAppendTimeout(t *testing.T) {
+	path := getLogPath()
+	log := NewLog(WithAppendCallbackTimeout(10 * time.Millisecond))
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+
+	release := make(chan bool)
+	defer close(release)
+	slow := make(chan uint64, 2)
+	var fast []uint64
+	log.OnAppend(func(entry *LogEntry) {
+		slow <- entry.index
+		<-release
+	})
+	log.OnAppend(func(entry *LogEntry) { fast = append(fast, entry.index) })
+
+	start := time.Now()
+	if err := log.Append(MakeEntry(log, 1, 1, "test", "foo")); err != nil {
+		t.Fatalf("Unable to append: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Append blocked on callback for %v", d)
+	}
+
+	// The slow callback is dropped while the others keep being called.
+	if err := log.Append(MakeEntry(log, 2, 1, "test", "foo")); err != nil {
+		t.Fatalf("Unable to append: %v", err)
+	}
+	if len(log.appendCallbacks) != 1 || len(slow) != 1 || !reflect.DeepEqual(fast, []uint64{1, 2}) {
+		t.Fatalf("Unexpected callbacks: %d (slow %d, fast %v)", len(log.appendCallbacks), len(slow), fast)
+	}
+}
+
+// Ensure that commit callbacks are called once per entry in index order.
+func TestLogOnCommit(t *testing.T) {
+	path := getLogPath()
+	log := NewLog()
+	MustRegisterTestCommand(log, "test")
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+
+	var calls []string
+	log.OnCommit(func(entry *LogEntry) {
+		// The entry must already be on disk.
+		b, _ := ioutil.ReadFile(path)
+		if !bytes.Contains(b, []byte(fmt.Sprintf(" %016x ", entry.index))) {
+			t.Errorf("Entry %d not written before callback", entry.index)
+		}
+		calls = append(calls, fmt.Sprintf("a%d", entry.index))
+	})
+	log.OnCommit(func(entry *LogEntry) {
+		calls = append(calls, fmt.Sprintf("b%d", entry.index))
+	})
+	for i := 1; i <= 5; i++ {
+		log.Append(MakeEntry(log, uint64(i), 1, "test", "foo"))
+	}
+
+	if err := log.SetCommitIndex(1); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if err := log.SetCommitIndex(4); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if err := log.SetCommitIndex(4); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if err := log.SetCommitIndex(5); err != nil {
+		t.Fatalf("Unable to commit: %v", err)
+	}
+	if exp := []string{"a1", "b1", "a2", "b2", "a3", "b3", "a4", "b4", "a5", "b5"}; !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("Unexpected calls: %v", calls)
+	}
+}
+
+// Ensure that committing an earlier index is only an error in strict mode.
+func TestLogSetCommitIndexIdempotent(t *testing.T) {
+	for _, idempotent := range []bool{false, true} {
+		path := getLogPath()
+		log := NewLog(WithIdempotentSetCommitIndex(idempotent))
+		MustRegisterTestCommand(log, "test")
+		if err := log.Open(path); err != nil {
+			t.Fatalf("Unable to open log: %v", err)
+		}
+		for i := 1; i <= 3; i++ {
+			log.Append(MakeEntry(log, uint64(i), 1, "test", "foo"))
+		}
+		if err := log.SetCommitIndex(2); err != nil {
+			t.Fatalf("Unable to commit: %v", err)
+		}
+
+		err := log.SetCommitIndex(1)
+		if idempotent && err != nil {
+			t.Fatalf("Unexpected error in idempotent mode: %v", err)
+		} else if !idempotent && err == nil {
+			t.Fatalf("Expected error in strict mode")
+		}
+		if err := log.SetCommitIndex(2); err != nil {
+			t.Fatalf("Unexpected error recommitting: %v", err)
+		}
+		if log.commitIndex != 2 {
+			t.Fatalf("Unexpected commit index: %d", log.commitIndex)
+		}
+		if b, _ := ioutil.ReadFile(path); bytes.Count(b, []byte("\n")) != 2 {
+			t.Fatalf("Unexpected log contents:\n%s", b)
+		}
+		log.Close()
+		os.Remove(path)
+	}
+}
+
+// Ensure that replay only visits committed entries after the snapshot index.
+func TestLogReplay(t *testing.T) {
+	path := setupLog(
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`4c08d91f 0000000000000002 0000000000000001 cmd_2 {"x":100}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n")
+	log := NewLog(WithSnapshotIndex(1))
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+	log.Append(NewLogEntry(log, 4, 2, &TestCommand2{200}))
+
+	var indices []uint64
+	if err := log.Replay(func(entry *LogEntry) error {
+		indices = append(indices, entry.index)
+		return nil
+	}); err != nil {
+		t.Fatalf("Unable to replay: %v", err)
+	}
+	if !reflect.DeepEqual(indices, []uint64{2, 3}) {
+		t.Fatalf("Unexpected replayed indices: %v", indices)
+	}
+
+	// Stop at the first error.
+	indices = nil
+	err := log.Replay(func(entry *LogEntry) error {
+		indices = append(indices, entry.index)
+		return fmt.Errorf("stop")
+	})
+	if err == nil || err.Error() != "stop" || len(indices) != 1 {
+		t.Fatalf("Unexpected replay: %v (%v)", indices, err)
+	}
+}
+
+func ExampleLog_Replay() {
+	path := setupLog(
+		`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}`+"\n" +
+		`6ac5807c 0000000000000003 0000000000000002 cmd_1 {"val":"bar","i":0}`+"\n")
+	defer os.Remove(path)
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	if err := log.Open(path); err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer log.Close()
+
+	// Rebuild an in-memory map from the committed commands.
+	state := make(map[string]int)
+	log.Replay(func(entry *LogEntry) error {
+		if command, ok := entry.command.(*TestCommand1); ok {
+			state[command.Val] = command.I
+		}
+		return nil
+	})
+	fmt.Println(state)
+	// Output: map[bar:0 foo:20]
+}
+
+// Ensure that concurrently assigned indices are unique and contiguous.
+func TestLogAppendNoIndex(t *testing.T) {
+	path := setupLog(`cf4aab23 0000000000000001 0000000000000001 cmd_1 {"val":"foo","i":20}` + "\n")
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	if err := log.Open(path); err != nil {
+		t.Fatalf("Unable to open log: %v", err)
+	}
+	defer log.Close()
+	defer os.Remove(path)
+
+	var mutex sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				index, err := log.AppendNoIndex(1, &TestCommand1{"bar", i})
+				if err != nil {
+					t.Errorf("Unable to append: %v", err)
+					return
+				}
+				mutex.Lock()
+				if seen[index] {
+					t.Errorf("Duplicate index: %d", index)
+				}
+				seen[index] = true
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(seen) != 1000 {
+		t.Fatalf("Expected 1000 indices, got %d", len(seen))
+	}
+	for i, entry := range log.entries {
+		if entry.index != uint64(i+1) {
+			t.Fatalf("Unexpected index at %d: %d", i, entry.index)
+		}
+	}
+}
+
+func BenchmarkLogAppendBatchFromReader(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		var buf bytes.Buffer
+		log := NewLog()
+		for i := 1; i <= n; i++ {
+			NewLogEntry(log, uint64(i), 1, &TestCommand1{"foo", i}).EncodeInto(&buf)
+		}
+		encoded := buf.Bytes()
+
+		b.Run(fmt.Sprintf("AppendBatchFromReader/n=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				log := NewLog()
+				log.AddCommandType(&TestCommand1{})
+				log.OpenWriter(ioutil.Discard)
+				if _, err := log.AppendBatchFromReader(bytes.NewReader(encoded), n); err != nil {
+					b.Fatalf("Unable to append: %v", err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("DecodeAppend/n=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				log := NewLog()
+				log.AddCommandType(&TestCommand1{})
+				log.OpenWriter(ioutil.Discard)
+				reader := bufio.NewReader(bytes.NewReader(encoded))
+				for j := 0; j < n; j++ {
+					entry := NewLogEntry(log, 0, 0, nil)
+					if _, err := entry.Decode(reader); err != nil {
+						b.Fatalf("Unable to decode: %v", err)
+					}
+					if err := log.Append(entry); err != nil {
+						b.Fatalf("Unable to append: %v", err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkLogEncodedSizeCached(b *testing.B) {
+	log := NewLog()
+	entry := MakeEntry(log, 1, 1, "test", "foo")
+	log.EncodedSize(entry)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		log.EncodedSize(entry)
+	}
+}
+
+func BenchmarkLogWriteBufferSize(b *testing.B) {
+	for _, size := range []int{0, 4096, 65536} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				path := getLogPath()
+				log := NewLog(WithWriteBufferSize(size))
+				log.AddCommandType(&TestCommand1{})
+				if err := log.Open(path); err != nil {
+					b.Fatalf("Unable to open log: %v", err)
+				}
+
+				// 1000 small entries committed in groups of 100.
+				for j := 1; j <= 1000; j++ {
+					log.Append(NewLogEntry(log, uint64(j), 1, &TestCommand1{"", j}))
+					if j%100 == 0 {
+						log.SetCommitIndex(uint64(j))
+					}
+				}
+				log.Close()
+				os.Remove(path)
+			}
+		})
+	}
+}
+
+func BenchmarkLogEphemeral(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		log := NewLog()
+		log.AddCommandType(&TestCommand1{})
+		log.OpenEphemeral()
+		for j := 1; j <= 1000; j++ {
+			log.Append(NewLogEntry(log, uint64(j), 1, &TestCommand1{"foo", j}))
+			if j%10 == 0 {
+				log.SetCommitIndex(uint64(j))
+			}
+		}
+	}
+	b.ReportMetric(float64(b.N*1000)/b.Elapsed().Seconds(), "entries/s")
+}
@@ -0,0 +1,170 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//------------------------------------------------------------------------------
+//
+// Constants
+//
+//------------------------------------------------------------------------------
+
+// The largest encoded message that will be sent or decoded. The length prefix
+// comes from the peer so it is checked before anything is allocated.
+const MaxMessageSize = 64 * 1024 * 1024
+
+const (
+	RequestVoteRequestMessage MessageType = iota + 1
+	RequestVoteResponseMessage
+	AppendEntriesRequestMessage
+	AppendEntriesResponseMessage
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// The type of message sent between servers.
+type MessageType uint8
+
+// A message wraps an RPC request or response with its type so that it can be
+// sent over any transport.
+type Message struct {
+	Type MessageType
+	Body interface{}
+}
+
+// The wire representation of a message.
+type encodedMessage struct {
+	Type MessageType     `json:"type"`
+	Body json.RawMessage `json:"body"`
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Creates a new message for an RPC request or response.
+func NewMessage(body interface{}) (*Message, error) {
+	m := &Message{Body: body}
+	switch body.(type) {
+	case *RequestVoteRequest:
+		m.Type = RequestVoteRequestMessage
+	case *RequestVoteResponse:
+		m.Type = RequestVoteResponseMessage
+	case *AppendEntriesRequest:
+		m.Type = AppendEntriesRequestMessage
+	case *AppendEntriesResponse:
+		m.Type = AppendEntriesResponseMessage
+	default:
+		return nil, fmt.Errorf("raft.Message: Unknown message body: %T", body)
+	}
+	return m, nil
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+//--------------------------------------
+// Encoding
+//--------------------------------------
+
+// Encodes the message to a writer as a 4-byte big endian length followed by
+// the JSON encoded message.
+// 先写长度再写内容，这样接收方不依赖具体的transport就能切分消息
+func (m *Message) Encode(w io.Writer) error {
+	body, err := json.Marshal(m.Body)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(&encodedMessage{Type: m.Type, Body: body})
+	if err != nil {
+		return err
+	} else if len(b) > MaxMessageSize {
+		return fmt.Errorf("raft.Message: Message too large: %d bytes", len(b))
+	}
+
+	if err = binary.Write(w, binary.BigEndian, uint32(len(b))); err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Decodes a single message from a reader. Entries in an append entries request
+// are associated with the log so their commands must be registered on it.
+func (l *Log) DecodeMessage(r io.Reader) (*Message, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	} else if size > MaxMessageSize {
+		return nil, fmt.Errorf("raft.Message: Message too large: %d bytes", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("raft.Message: Unable to read message: %v", err)
+	}
+
+	var em encodedMessage
+	if err := json.Unmarshal(b, &em); err != nil {
+		return nil, fmt.Errorf("raft.Message: Unable to decode: %v", err)
+	}
+
+	m := &Message{Type: em.Type}
+	var err error
+	switch em.Type {
+	case RequestVoteRequestMessage:
+		m.Body = &RequestVoteRequest{}
+	case RequestVoteResponseMessage:
+		m.Body = &RequestVoteResponse{}
+	case AppendEntriesRequestMessage:
+		m.Body, err = l.decodeAppendEntriesRequest(em.Body)
+	case AppendEntriesResponseMessage:
+		m.Body = &AppendEntriesResponse{}
+	default:
+		return nil, fmt.Errorf("raft.Message: Unknown message type: %d", em.Type)
+	}
+	if err == nil && em.Type != AppendEntriesRequestMessage {
+		err = json.Unmarshal(em.Body, m.Body)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("raft.Message: Unable to decode body: %v", err)
+	}
+	return m, nil
+}
+
+// Decodes an append entries request along with each of its entries.
+func (l *Log) decodeAppendEntriesRequest(b []byte) (*AppendEntriesRequest, error) {
+	// Entries are encoded in the log format so read them as strings first.
+	var body struct {
+		AppendEntriesRequest
+		Entries []string `json:"entries"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, err
+	}
+
+	req := &body.AppendEntriesRequest
+	req.Entries = nil
+	for _, s := range body.Entries {
+		entry := NewLogEntry(l, 0, 0, nil)
+		if _, err := entry.Decode(bufio.NewReader(strings.NewReader(s))); err != nil {
+			return nil, err
+		}
+		req.Entries = append(req.Entries, entry)
+	}
+	return req, nil
+}
@@ -0,0 +1,82 @@
+package raft
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that every message type can be encoded and decoded.
+func TestMessageEncodeDecode(t *testing.T) {
+	log := NewLog()
+	log.AddCommandType(&TestCommand1{})
+	log.AddCommandType(&TestCommand2{})
+
+	bodies := []interface{}{
+		&RequestVoteRequest{Term: 2, CandidateId: 3, LastLogIndex: 10, LastLogTerm: 1},
+		&RequestVoteResponse{Term: 2, VoteGranted: true},
+		&AppendEntriesRequest{
+			Term:         2,
+			LeaderId:     3,
+			PrevLogIndex: 1,
+			PrevLogTerm:  1,
+			Entries: []*LogEntry{
+				NewLogEntry(log, 2, 1, &TestCommand2{100}),
+				NewLogEntry(log, 3, 2, &TestCommand1{"bar", 0}),
+			},
+			CommitIndex: 1,
+		},
+		&AppendEntriesRequest{Term: 2, LeaderId: 3},
+		&AppendEntriesResponse{Term: 2, Success: true},
+	}
+
+	// Encode all messages into a single stream.
+	var buf bytes.Buffer
+	for i, body := range bodies {
+		m, err := NewMessage(body)
+		if err != nil {
+			t.Fatalf("%d. Unable to create message: %v", i, err)
+		}
+		if err := m.Encode(&buf); err != nil {
+			t.Fatalf("%d. Unable to encode: %v", i, err)
+		}
+	}
+
+	// Read them back in order.
+	for i, body := range bodies {
+		m, err := log.DecodeMessage(&buf)
+		if err != nil {
+			t.Fatalf("%d. Unable to decode: %v", i, err)
+		}
+		if !reflect.DeepEqual(m.Body, body) {
+			t.Fatalf("%d. Unexpected body: %#v", i, m.Body)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("Unexpected trailing bytes: %d", buf.Len())
+	}
+}
+
+// Ensure that unknown message bodies are rejected.
+func TestNewMessageUnknownBody(t *testing.T) {
+	if _, err := NewMessage("foo"); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
+
+// Ensure that a message larger than the maximum size is rejected before it is
+// read.
+func TestDecodeMessageTooLarge(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(MaxMessageSize+1))
+	if _, err := NewLog().DecodeMessage(&buf); err == nil {
+		t.Fatalf("Expected error")
+	}
+}
@@ -0,0 +1,113 @@
+// Package raftwall locks ranges of log indices so that entries can be applied
+// to a state machine concurrently without overlapping ranges interfering.
+package raftwall
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+//------------------------------------------------------------------------------
+//
+// Typedefs
+//
+//------------------------------------------------------------------------------
+
+// An inclusive range of log indices to lock.
+type EntryRangeLock struct {
+	MinIndex uint64
+	MaxIndex uint64
+}
+
+// A lock manager grants locks on ranges of log indices. A range is locked
+// only while it does not overlap any other locked range.
+type LockManager struct {
+	held  []EntryRangeLock
+	mutex sync.Mutex
+	cond  *sync.Cond
+}
+
+//------------------------------------------------------------------------------
+//
+// Constructor
+//
+//------------------------------------------------------------------------------
+
+// Creates a new lock manager with no ranges locked.
+func NewLockManager() *LockManager {
+	m := &LockManager{}
+	m.cond = sync.NewCond(&m.mutex)
+	return m
+}
+
+//------------------------------------------------------------------------------
+//
+// Methods
+//
+//------------------------------------------------------------------------------
+
+// Returns true if two ranges share at least one index.
+func (r EntryRangeLock) Overlaps(other EntryRangeLock) bool {
+	return r.MinIndex <= other.MaxIndex && other.MinIndex <= r.MaxIndex
+}
+
+// Blocks until the range can be locked or the context is done. Returns the
+// context's error if it is done first.
+// 跟数据库的行锁类似，只是锁的是log index区间
+func (m *LockManager) Lock(ctx context.Context, r EntryRangeLock) error {
+	if r.MinIndex > r.MaxIndex {
+		return fmt.Errorf("raftwall.LockManager: Invalid range: %d > %d", r.MinIndex, r.MaxIndex)
+	}
+
+	// Wake up waiters when the context is done so this one can give up.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.mutex.Lock()
+			m.cond.Broadcast()
+			m.mutex.Unlock()
+		case <-stop:
+		}
+	}()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for m.overlaps(r) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m.cond.Wait()
+	}
+	m.held = append(m.held, r)
+	return nil
+}
+
+// Unlocks a range previously locked with Lock. Panics if the range is not
+// locked.
+func (m *LockManager) Unlock(r EntryRangeLock) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for i, held := range m.held {
+		if held == r {
+			m.held = append(m.held[:i], m.held[i+1:]...)
+			m.cond.Broadcast()
+			return
+		}
+	}
+	panic(fmt.Sprintf("raftwall.LockManager: Unlock of unlocked range %d-%d", r.MinIndex, r.MaxIndex))
+}
+
+// Returns true if a range overlaps any locked range. The caller must hold the
+// lock.
+func (m *LockManager) overlaps(r EntryRangeLock) bool {
+	for _, held := range m.held {
+		if held.Overlaps(r) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package raftwall
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that non-overlapping ranges can be locked at the same time.
+func TestLockManagerNonOverlapping(t *testing.T) {
+	m := NewLockManager()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := uint64(0); i < 10; i++ {
+		wg.Add(1)
+		go func(r EntryRangeLock) {
+			defer wg.Done()
+			if err := m.Lock(ctx, r); err != nil {
+				t.Errorf("Unable to lock %v: %v", r, err)
+			}
+		}(EntryRangeLock{MinIndex: i * 10, MaxIndex: i*10 + 9})
+	}
+	wg.Wait()
+	if len(m.held) != 10 {
+		t.Fatalf("Expected 10 held ranges, got %d", len(m.held))
+	}
+}
+
+// Ensure that overlapping ranges are held one at a time.
+func TestLockManagerOverlapping(t *testing.T) {
+	m := NewLockManager()
+	ctx := context.Background()
+
+	var mutex sync.Mutex
+	active, maxActive := 0, 0
+	var wg sync.WaitGroup
+	for i := uint64(0); i < 10; i++ {
+		wg.Add(1)
+		go func(r EntryRangeLock) {
+			defer wg.Done()
+			if err := m.Lock(ctx, r); err != nil {
+				t.Errorf("Unable to lock %v: %v", r, err)
+				return
+			}
+			mutex.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mutex.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mutex.Lock()
+			active--
+			mutex.Unlock()
+			m.Unlock(r)
+		}(EntryRangeLock{MinIndex: i, MaxIndex: 100})
+	}
+	wg.Wait()
+	if maxActive != 1 {
+		t.Fatalf("Expected overlapping ranges to serialize, got %d at once", maxActive)
+	}
+}
+
+// Ensure that a waiting lock gives up when its context is done.
+func TestLockManagerContext(t *testing.T) {
+	m := NewLockManager()
+	r := EntryRangeLock{MinIndex: 1, MaxIndex: 5}
+	if err := m.Lock(context.Background(), r); err != nil {
+		t.Fatalf("Unable to lock: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.Lock(ctx, EntryRangeLock{MinIndex: 5, MaxIndex: 9}); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded: %v", err)
+	}
+	if err := m.Lock(ctx, EntryRangeLock{MinIndex: 2, MaxIndex: 1}); err == nil {
+		t.Fatalf("Expected error for invalid range")
+	}
+
+	m.Unlock(r)
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Expected panic unlocking an unlocked range")
+		}
+	}()
+	m.Unlock(r)
+}
@@ -25,8 +25,12 @@ type Server struct {
 	currentTerm int
 	state       int
 	votedFor    int
+	clock       Clock
 }
 
+// A server option configures a server when it is created.
+type ServerOption func(*Server)
+
 //--------------------------------------
 // Replicas
 //--------------------------------------
@@ -85,9 +89,25 @@ type AppendEntriesResponse struct {
 //------------------------------------------------------------------------------
 
 // Creates a new server.
-func NewServer() *Server {
-	return &Server{
+func NewServer(options ...ServerOption) *Server {
+	s := &Server{
 		state: Follower,
+		clock: RealClock{},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+//--------------------------------------
+// Options
+//--------------------------------------
+
+// Sets the clock used for election and heartbeat timeouts.
+func WithClock(c Clock) ServerOption {
+	return func(s *Server) {
+		s.clock = c
 	}
 }
 
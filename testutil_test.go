@@ -0,0 +1,77 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+//
+// Setup
+//
+//------------------------------------------------------------------------------
+
+// A generic command for tests that do not depend on a specific command type.
+type TestCommand struct {
+	Value string `json:"value"`
+}
+
+func (c TestCommand) Name() string {
+	return "test"
+}
+
+// Commands for tests that need entries with more than one command name.
+type TestFooCommand struct {
+	Value string `json:"value"`
+}
+
+func (c TestFooCommand) Name() string {
+	return "foo"
+}
+
+type TestBarCommand struct {
+	Value string `json:"value"`
+}
+
+func (c TestBarCommand) Name() string {
+	return "bar"
+}
+
+// Creates a test command by name. Each name has its own type so that Name()
+// does not depend on the command's fields.
+func newTestCommand(name, value string) Command {
+	switch name {
+	case "test":
+		return &TestCommand{Value: value}
+	case "foo":
+		return &TestFooCommand{Value: value}
+	case "bar":
+		return &TestBarCommand{Value: value}
+	}
+	panic(fmt.Sprintf("raft: Unknown test command: %s", name))
+}
+
+// Registers the test command type with the given name on a log.
+func MustRegisterTestCommand(log *Log, name string) {
+	log.AddCommandType(newTestCommand(name, ""))
+}
+
+// Creates an entry holding a test command.
+func MakeEntry(log *Log, index, term uint64, name, value string) *LogEntry {
+	return NewLogEntry(log, index, term, newTestCommand(name, value))
+}
+
+//------------------------------------------------------------------------------
+//
+// Tests
+//
+//------------------------------------------------------------------------------
+
+// Ensure that the test commands pass the command checker.
+func TestTestCommandCheck(t *testing.T) {
+	for _, name := range []string{"test", "foo", "bar"} {
+		if issues := CheckCommand(newTestCommand(name, "x")); len(issues) != 0 {
+			t.Fatalf("Unexpected issues for %s: %v", name, issues)
+		}
+	}
+}